@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	ssh "github.com/zywillc/drone-chef-client/ssh"
+)
+
+var (
+	runListItemRe = regexp.MustCompile(`^(recipe\[[A-Za-z0-9_.:@-]+\]|role\[[A-Za-z0-9_.-]+\]|[A-Za-z0-9_.-]+(::[A-Za-z0-9_.-]+)?)$`)
+	chefNameRe    = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+	logLevels    = []string{"auto", "trace", "debug", "info", "warn", "error", "fatal"}
+	chefLicenses = []string{"accept", "accept-silent", "accept-no-persist"}
+)
+
+// validateChefOptions checks the chef-client settings before anything is
+// sent to a remote host.
+func (c Config) validateChefOptions() error {
+	for _, item := range append(append([]string{}, c.runList...), c.overrideRunList...) {
+		if !runListItemRe.MatchString(item) {
+			return fmt.Errorf("invalid run list item %q", item)
+		}
+	}
+	if c.environment != "" && !chefNameRe.MatchString(c.environment) {
+		return fmt.Errorf("invalid environment %q", c.environment)
+	}
+	if c.namedRunList != "" && !chefNameRe.MatchString(c.namedRunList) {
+		return fmt.Errorf("invalid named run list %q", c.namedRunList)
+	}
+	if c.nodeName != "" && !chefNameRe.MatchString(c.nodeName) {
+		return fmt.Errorf("invalid node name %q", c.nodeName)
+	}
+	if c.policyName != "" && !chefNameRe.MatchString(c.policyName) {
+		return fmt.Errorf("invalid policy name %q", c.policyName)
+	}
+	if c.policyGroup != "" && !chefNameRe.MatchString(c.policyGroup) {
+		return fmt.Errorf("invalid policy group %q", c.policyGroup)
+	}
+	if c.policyArchive == "" && (c.policyName == "") != (c.policyGroup == "") {
+		return fmt.Errorf("policy name and policy group must be set together")
+	}
+	if c.policyArchive != "" && c.policyGroup != "" {
+		return fmt.Errorf("policy group can not be set with a policy archive, which converges its exported group")
+	}
+	if c.policyName != "" || c.policyArchive != "" {
+		if len(c.runList) > 0 || c.environment != "" {
+			return fmt.Errorf("run list and environment can not be combined with a policy")
+		}
+	}
+	if c.logLevel != "" && !contains(logLevels, c.logLevel) {
+		return fmt.Errorf("invalid log level %q, expected one of %s", c.logLevel, strings.Join(logLevels, ", "))
+	}
+	if c.chefLicense != "" && !contains(chefLicenses, c.chefLicense) {
+		return fmt.Errorf("invalid chef license %q, expected one of %s", c.chefLicense, strings.Join(chefLicenses, ", "))
+	}
+	if isInlineJSON(c.jsonAttributes) && !json.Valid([]byte(c.jsonAttributes)) {
+		return fmt.Errorf("invalid json attributes: not valid JSON")
+	}
+	if err := c.validateClientRB(); err != nil {
+		return err
+	}
+	if c.localMode && c.policyArchive == "" {
+		if _, err := localRepoLayout(c.cookbookPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chefCommand builds the chef-client command line. attributes is the
+// remote path or URL passed to -j, if any.
+func (c Config) chefCommand(attributes string) string {
+	args := []string{"chef-client"}
+
+	if c.localMode {
+		args = append(args, "-z")
+	}
+	if c.writeClientRB && c.clientRBPath != DefaultClientRBPath {
+		args = append(args, "-c", ssh.ShellQuote(c.clientRBPath))
+	}
+
+	if len(c.runList) > 0 {
+		args = append(args, "-r", ssh.ShellQuote(strings.Join(c.runList, ",")))
+	}
+	if len(c.overrideRunList) > 0 {
+		args = append(args, "-o", ssh.ShellQuote(strings.Join(c.overrideRunList, ",")))
+	}
+	if c.namedRunList != "" {
+		args = append(args, "-n", ssh.ShellQuote(c.namedRunList))
+	}
+	if c.environment != "" {
+		args = append(args, "-E", ssh.ShellQuote(c.environment))
+	}
+	// an exported policy names itself in its .chef/config.rb
+	if c.policyName != "" && c.policyArchive == "" {
+		args = append(args, "--policy-name", ssh.ShellQuote(c.policyName))
+		args = append(args, "--policy-group", ssh.ShellQuote(c.policyGroup))
+	}
+	if attributes != "" {
+		args = append(args, "-j", ssh.ShellQuote(attributes))
+	}
+	if c.nodeName != "" {
+		args = append(args, "-N", ssh.ShellQuote(c.nodeName))
+	}
+	if c.logLevel != "" {
+		args = append(args, "-l", ssh.ShellQuote(c.logLevel))
+	}
+	if c.whyRun {
+		args = append(args, "--why-run")
+	}
+	if c.forceFormatter {
+		args = append(args, "--force-formatter")
+	}
+	if c.chefLicense != "" {
+		args = append(args, "--chef-license", ssh.ShellQuote(c.chefLicense))
+	}
+	for _, a := range c.extraArgs {
+		args = append(args, ssh.ShellQuote(a))
+	}
+
+	return strings.Join(args, " ")
+}
+
+// isInlineJSON reports whether the json-attributes setting holds the
+// attributes themselves rather than a path or URL.
+func isInlineJSON(s string) bool {
+	return strings.HasPrefix(strings.TrimSpace(s), "{")
+}
+
+// remoteTempPath returns a unique path under /var/tmp on the remote host.
+// Unlike /tmp it survives the reboots a converge may trigger.
+func remoteTempPath(prefix, suffix string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("/var/tmp/%s-%s%s", prefix, hex.EncodeToString(b), suffix)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
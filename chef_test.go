@@ -0,0 +1,172 @@
+package main
+
+import "testing"
+
+func TestChefCommand(t *testing.T) {
+	cases := []struct {
+		name       string
+		conf       Config
+		attributes string
+		command    string
+	}{
+		{
+			name:    "defaults",
+			command: "chef-client",
+		},
+		{
+			name:    "run list",
+			conf:    Config{runList: []string{"recipe[base::default]", "role[web]"}},
+			command: "chef-client -r 'recipe[base::default],role[web]'",
+		},
+		{
+			name: "all options",
+			conf: Config{
+				runList:         []string{"base"},
+				overrideRunList: []string{"recipe[hotfix]"},
+				namedRunList:    "deploy",
+				environment:     "production",
+				nodeName:        "web-1.example.com",
+				logLevel:        "info",
+				whyRun:          true,
+				forceFormatter:  true,
+				chefLicense:     "accept-no-persist",
+			},
+			attributes: "/var/tmp/attributes.json",
+			command: "chef-client -r 'base' -o 'recipe[hotfix]' -n 'deploy' -E 'production'" +
+				" -j '/var/tmp/attributes.json' -N 'web-1.example.com' -l 'info'" +
+				" --why-run --force-formatter --chef-license 'accept-no-persist'",
+		},
+		{
+			name:    "policy",
+			conf:    Config{policyName: "web", policyGroup: "production"},
+			command: "chef-client --policy-name 'web' --policy-group 'production'",
+		},
+		{
+			name:    "policy archive",
+			conf:    Config{localMode: true, policyName: "web", policyArchive: "web-1a2b.tgz"},
+			command: "chef-client -z",
+		},
+		{
+			name:       "attributes path with shell syntax",
+			attributes: "/var/tmp/a b;$(reboot)`id`.json",
+			command:    "chef-client -j '/var/tmp/a b;$(reboot)`id`.json'",
+		},
+		{
+			name:       "attributes url",
+			attributes: "https://example.com/attributes.json?node=web&env=prod",
+			command:    "chef-client -j 'https://example.com/attributes.json?node=web&env=prod'",
+		},
+		{
+			name:    "extra args",
+			conf:    Config{extraArgs: []string{"--config-option", "ssl_verify_mode=:verify_none", "a b"}},
+			command: "chef-client '--config-option' 'ssl_verify_mode=:verify_none' 'a b'",
+		},
+		{
+			name:    "extra args with quotes",
+			conf:    Config{extraArgs: []string{"it's", "'; reboot; '", ""}},
+			command: `chef-client 'it'\''s' ''\''; reboot; '\''' ''`,
+		},
+		{
+			name:    "extra args with substitutions",
+			conf:    Config{extraArgs: []string{"$(reboot)", "`id`", "$HOME", "a\nb"}},
+			command: "chef-client '$(reboot)' '`id`' '$HOME' 'a\nb'",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if command := c.conf.chefCommand(c.attributes); command != c.command {
+				t.Errorf("command =\n%s\nwant\n%s", command, c.command)
+			}
+		})
+	}
+}
+
+func TestValidateChefOptions(t *testing.T) {
+	cases := []struct {
+		name string
+		conf Config
+		err  bool
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name: "valid",
+			conf: Config{
+				runList:         []string{"base", "base::users", "recipe[base::ntp@1.2.3]", "role[web]"},
+				overrideRunList: []string{"recipe[hotfix]"},
+				namedRunList:    "deploy",
+				environment:     "production",
+				nodeName:        "web-1.example.com",
+				logLevel:        "warn",
+				chefLicense:     "accept",
+				jsonAttributes:  `{"ntp": {"servers": ["pool.ntp.org"]}}`,
+			},
+		},
+		{
+			name: "attributes path",
+			conf: Config{jsonAttributes: "attributes/web.json"},
+		},
+		{
+			name: "policy",
+			conf: Config{policyName: "web", policyGroup: "production", overrideRunList: []string{"recipe[hotfix]"}},
+		},
+		{
+			name: "policy archive",
+			conf: Config{policyName: "web", policyArchive: "web-1a2b.tgz"},
+		},
+		{name: "policy name without group", conf: Config{policyName: "web"}, err: true},
+		{name: "policy group without name", conf: Config{policyGroup: "production"}, err: true},
+		{name: "policy group with archive", conf: Config{policyGroup: "production", policyArchive: "web-1a2b.tgz"}, err: true},
+		{name: "policy name", conf: Config{policyName: "web;reboot", policyGroup: "production"}, err: true},
+		{name: "policy group", conf: Config{policyName: "web", policyGroup: "$(id)"}, err: true},
+		{
+			name: "policy with run list",
+			conf: Config{policyName: "web", policyGroup: "production", runList: []string{"base"}},
+			err:  true,
+		},
+		{
+			name: "policy with environment",
+			conf: Config{policyName: "web", policyGroup: "production", environment: "production"},
+			err:  true,
+		},
+		{name: "policy archive with run list", conf: Config{policyArchive: "web-1a2b.tgz", runList: []string{"base"}}, err: true},
+		{
+			name: "client.rb",
+			conf: Config{writeClientRB: true, clientRBPath: DefaultClientRBPath, chefServerURL: "https://chef.example.com/organizations/ops"},
+		},
+		{name: "client.rb with a relative path", conf: Config{writeClientRB: true, clientRBPath: "client.rb"}, err: true},
+		{
+			name: "client.rb in local mode",
+			conf: Config{writeClientRB: true, clientRBPath: DefaultClientRBPath, localMode: true, cookbookPath: "."},
+			err:  true,
+		},
+		{
+			name: "client.rb with a policy archive",
+			conf: Config{writeClientRB: true, clientRBPath: DefaultClientRBPath, whyRun: true, policyArchive: "web-1a2b.tgz"},
+			err:  true,
+		},
+		{name: "run list with a command", conf: Config{runList: []string{"recipe[base];reboot"}}, err: true},
+		{name: "run list with a substitution", conf: Config{runList: []string{"role[web]$(id)"}}, err: true},
+		{name: "run list with a space", conf: Config{runList: []string{"recipe[base] role[web]"}}, err: true},
+		{name: "run list with a quote", conf: Config{runList: []string{"base'"}}, err: true},
+		{name: "empty run list item", conf: Config{runList: []string{""}}, err: true},
+		{name: "override run list", conf: Config{overrideRunList: []string{"recipe[x]`id`"}}, err: true},
+		{name: "environment", conf: Config{environment: "prod env"}, err: true},
+		{name: "named run list", conf: Config{namedRunList: "$(reboot)"}, err: true},
+		{name: "node name", conf: Config{nodeName: "web;reboot"}, err: true},
+		{name: "log level", conf: Config{logLevel: "loud"}, err: true},
+		{name: "chef license", conf: Config{chefLicense: "yes"}, err: true},
+		{name: "inline attributes", conf: Config{jsonAttributes: `{"ntp": `}, err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.conf.validateChefOptions()
+			if (err != nil) != c.err {
+				t.Errorf("error = %v, want error: %t", err, c.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	ssh "github.com/zywillc/drone-chef-client/ssh"
+)
+
+// DefaultClientRBPath is where client.rb is written if there is no path given
+const DefaultClientRBPath = "/etc/chef/client.rb"
+
+var sslVerifyModes = []string{"verify_peer", "verify_none"}
+
+// validateClientRB checks the client.rb settings.
+func (c Config) validateClientRB() error {
+	if !c.writeClientRB {
+		return nil
+	}
+
+	// chef-client -z reads .chef/config.rb from the repo instead, and -c
+	// would replace the one a policy export names itself in
+	if c.localMode || c.policyArchive != "" {
+		return fmt.Errorf("write client.rb can not be combined with local mode or a policy archive")
+	}
+	if !path.IsAbs(c.clientRBPath) {
+		return fmt.Errorf("invalid client.rb path %q: not absolute", c.clientRBPath)
+	}
+	if c.chefServerURL != "" {
+		if err := validateURL(c.chefServerURL); err != nil {
+			return fmt.Errorf("invalid chef server url: %s", err)
+		}
+	}
+	if c.proxy != "" {
+		if err := validateURL(c.proxy); err != nil {
+			return fmt.Errorf("invalid proxy: %s", err)
+		}
+	}
+	if c.sslVerifyMode != "" && !contains(sslVerifyModes, c.sslVerifyMode) {
+		return fmt.Errorf("invalid ssl verify mode %q, expected one of %s", c.sslVerifyMode, strings.Join(sslVerifyModes, ", "))
+	}
+	return nil
+}
+
+func validateURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http or https url", s)
+	}
+	return nil
+}
+
+// clientRB renders client.rb from the settings.
+func (c Config) clientRB() []byte {
+	var b bytes.Buffer
+	b.WriteString("# Generated by drone-chef-client, local changes are overwritten\n")
+
+	if c.chefServerURL != "" {
+		fmt.Fprintf(&b, "chef_server_url %s\n", rubyString(c.chefServerURL))
+	}
+	if c.nodeName != "" {
+		fmt.Fprintf(&b, "node_name %s\n", rubyString(c.nodeName))
+	}
+	if c.environment != "" {
+		fmt.Fprintf(&b, "environment %s\n", rubyString(c.environment))
+	}
+	if c.sslVerifyMode != "" {
+		fmt.Fprintf(&b, "ssl_verify_mode :%s\n", c.sslVerifyMode)
+	}
+	if c.logLocation != "" {
+		fmt.Fprintf(&b, "log_location %s\n", rubyLogLocation(c.logLocation))
+	}
+	if c.fileCachePath != "" {
+		fmt.Fprintf(&b, "file_cache_path %s\n", rubyString(c.fileCachePath))
+	}
+	if c.proxy != "" {
+		fmt.Fprintf(&b, "http_proxy %s\n", rubyString(c.proxy))
+		fmt.Fprintf(&b, "https_proxy %s\n", rubyString(c.proxy))
+	}
+	if extra := strings.TrimRight(c.clientRBExtra, "\n"); extra != "" {
+		b.WriteString(extra + "\n")
+	}
+
+	return b.Bytes()
+}
+
+// rubyString quotes s as a single-quoted Ruby string literal.
+func rubyString(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return "'" + strings.Replace(s, "'", `\'`, -1) + "'"
+}
+
+// rubyLogLocation turns the log location setting into Ruby, keeping the
+// standard streams and syslog as the objects chef-client expects.
+func rubyLogLocation(s string) string {
+	switch s {
+	case "STDOUT", "STDERR":
+		return s
+	case "syslog", ":syslog":
+		return ":syslog"
+	}
+	return rubyString(s)
+}
+
+// installClientRB writes the rendered client.rb to the target. The file is
+// staged next to its destination and renamed over it, so chef-client never
+// reads a partial file, and ends up owned by root and not writable by others.
+func (r *remote) installClientRB() error {
+	tmp, err := r.uploadClientRB()
+	if err != nil {
+		return err
+	}
+	defer r.cleanup("rm -f "+ssh.ShellQuote(tmp), false)
+
+	dst := r.conf.clientRBPath
+	dir := path.Dir(dst)
+	staged := path.Join(dir, "."+path.Base(dst)+".tmp")
+	script := fmt.Sprintf("mkdir -p %s && install -m 644 %s %s && mv -f %s %s",
+		ssh.ShellQuote(dir),
+		ssh.ShellQuote(tmp), ssh.ShellQuote(staged),
+		ssh.ShellQuote(staged), ssh.ShellQuote(dst),
+	)
+	if err := r.sudo("sh -c " + ssh.ShellQuote(script)); err != nil {
+		return fmt.Errorf("error installing %s: %s", dst, err)
+	}
+	return nil
+}
+
+// uploadClientRB writes the rendered client.rb to a private temp file on the
+// target and returns its path.
+func (r *remote) uploadClientRB() (string, error) {
+	tmp := remoteTempPath("drone-chef-client", ".rb")
+	if err := r.writeFile(tmp, r.conf.clientRB()); err != nil {
+		return "", fmt.Errorf("error uploading client.rb: %s", err)
+	}
+	return tmp, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import "testing"
+
+func TestRubyString(t *testing.T) {
+	cases := []struct {
+		input string
+		ruby  string
+	}{
+		{"", `''`},
+		{"https://chef.example.com/organizations/ops", `'https://chef.example.com/organizations/ops'`},
+		{"it's", `'it\'s'`},
+		{`C:\chef\cache`, `'C:\\chef\\cache'`},
+		{`\'`, `'\\\''`},
+		{"#{`reboot`}", "'#{`reboot`}'"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			if ruby := rubyString(c.input); ruby != c.ruby {
+				t.Errorf("rubyString(%q) = %s, want %s", c.input, ruby, c.ruby)
+			}
+		})
+	}
+}
+
+func TestClientRB(t *testing.T) {
+	const header = "# Generated by drone-chef-client, local changes are overwritten\n"
+
+	cases := []struct {
+		name string
+		conf Config
+		rb   string
+	}{
+		{
+			name: "empty",
+			rb:   header,
+		},
+		{
+			name: "all settings",
+			conf: Config{
+				chefServerURL: "https://chef.example.com/organizations/ops",
+				nodeName:      "web-1",
+				environment:   "production",
+				sslVerifyMode: "verify_peer",
+				logLocation:   "/var/log/chef/client.log",
+				fileCachePath: "/var/chef/cache",
+				proxy:         "http://proxy:3128",
+				clientRBExtra: "chef_license 'accept'\n\n",
+			},
+			rb: header +
+				"chef_server_url 'https://chef.example.com/organizations/ops'\n" +
+				"node_name 'web-1'\n" +
+				"environment 'production'\n" +
+				"ssl_verify_mode :verify_peer\n" +
+				"log_location '/var/log/chef/client.log'\n" +
+				"file_cache_path '/var/chef/cache'\n" +
+				"http_proxy 'http://proxy:3128'\n" +
+				"https_proxy 'http://proxy:3128'\n" +
+				"chef_license 'accept'\n",
+		},
+		{
+			name: "quoted node name",
+			conf: Config{nodeName: "web'1"},
+			rb:   header + "node_name 'web\\'1'\n",
+		},
+		{
+			name: "standard stream",
+			conf: Config{logLocation: "STDOUT"},
+			rb:   header + "log_location STDOUT\n",
+		},
+		{
+			name: "syslog",
+			conf: Config{logLocation: "syslog"},
+			rb:   header + "log_location :syslog\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if rb := string(c.conf.clientRB()); rb != c.rb {
+				t.Errorf("client.rb =\n%s\nwant\n%s", rb, c.rb)
+			}
+		})
+	}
+}
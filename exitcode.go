@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	ssh "github.com/zywillc/drone-chef-client/ssh"
+)
+
+// RunState is the outcome of a chef-client run, derived from its exit code
+// or from the error that kept it from reporting one.
+type RunState int
+
+const (
+	StateSuccess RunState = iota
+	StateFailed
+	StateInterrupted
+	StateRebootScheduled
+	StateRebootNeeded
+	StateRebootNow
+	StateRebootFailed
+	StateAuditFailure
+	StateClientUpgrade
+
+	// the run ended without an exit code, so these always fail and are
+	// outside the exit code policy
+	StateTimedOut
+	StateCancelled
+	StateConnectionError
+)
+
+var stateNames = map[RunState]string{
+	StateSuccess:         "success",
+	StateFailed:          "failed",
+	StateInterrupted:     "interrupted",
+	StateRebootScheduled: "reboot-scheduled",
+	StateRebootNeeded:    "reboot-needed",
+	StateRebootNow:       "reboot-now",
+	StateRebootFailed:    "reboot-failed",
+	StateAuditFailure:    "audit-failure",
+	StateClientUpgrade:   "client-upgrade",
+	StateTimedOut:        "timed-out",
+	StateCancelled:       "cancelled",
+	StateConnectionError: "connection-error",
+}
+
+func (s RunState) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
+// hasExitCode reports whether the state comes from chef-client's exit code,
+// which the exit code policy applies to.
+func (s RunState) hasExitCode() bool {
+	return s < StateTimedOut
+}
+
+// stateForExitStatus maps the chef-client exit codes documented in Chef
+// RFC 062 to a RunState.
+func stateForExitStatus(status int) RunState {
+	switch status {
+	case 0:
+		return StateSuccess
+	case 2, 3:
+		return StateInterrupted
+	case 35:
+		return StateRebootScheduled
+	case 37:
+		return StateRebootNeeded
+	case 40:
+		return StateRebootNow
+	case 41:
+		return StateRebootFailed
+	case 42:
+		return StateAuditFailure
+	case 213:
+		return StateClientUpgrade
+	}
+	return StateFailed
+}
+
+// classifyRun returns the state of a finished chef-client run. A run that
+// was stopped, or lost its connection, has no exit code to go by.
+func classifyRun(err error) RunState {
+	switch {
+	case err == nil:
+		return StateSuccess
+	case ssh.IsCancelled(err):
+		return StateCancelled
+	case ssh.IsTimeout(err):
+		return StateTimedOut
+	}
+	if exitErr, ok := err.(*ssh.ExitError); ok && exitErr.Err == nil {
+		return stateForExitStatus(exitErr.ExitStatus)
+	}
+	return StateConnectionError
+}
+
+// ExitAction is what the plugin does when a run ends in a given state.
+type ExitAction string
+
+const (
+	ActionSuccess ExitAction = "success"
+	ActionFail    ExitAction = "fail"
+	ActionReboot  ExitAction = "reboot"
+)
+
+// defaultExitPolicy treats the states in which chef-client reboots the node
+// itself as success, and everything else that is not a clean run as failure.
+var defaultExitPolicy = map[RunState]ExitAction{
+	StateSuccess:         ActionSuccess,
+	StateFailed:          ActionFail,
+	StateInterrupted:     ActionFail,
+	StateRebootScheduled: ActionSuccess,
+	StateRebootNeeded:    ActionFail,
+	StateRebootNow:       ActionSuccess,
+	StateRebootFailed:    ActionFail,
+	StateAuditFailure:    ActionFail,
+	StateClientUpgrade:   ActionFail,
+}
+
+// parseExitPolicy overlays state=action entries on the default policy.
+func parseExitPolicy(entries []string) (map[RunState]ExitAction, error) {
+	policy := make(map[RunState]ExitAction, len(defaultExitPolicy))
+	for state, action := range defaultExitPolicy {
+		policy[state] = action
+	}
+
+	for _, e := range entries {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid exit code policy %q, expected state=action", e)
+		}
+		name := strings.TrimSpace(parts[0])
+		action := ExitAction(strings.TrimSpace(parts[1]))
+
+		state, ok := stateByName(name)
+		if !ok || state == StateSuccess || !state.hasExitCode() {
+			return nil, fmt.Errorf("invalid exit code policy %q: unknown state %q", e, name)
+		}
+		switch action {
+		case ActionSuccess, ActionFail, ActionReboot:
+		default:
+			return nil, fmt.Errorf("invalid exit code policy %q: action must be success, fail or reboot", e)
+		}
+		policy[state] = action
+	}
+
+	return policy, nil
+}
+
+func stateByName(name string) (RunState, bool) {
+	for state, n := range stateNames {
+		if n == name {
+			return state, true
+		}
+	}
+	return 0, false
+}
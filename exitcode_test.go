@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	ssh "github.com/zywillc/drone-chef-client/ssh"
+)
+
+func TestParseExitPolicy(t *testing.T) {
+	cases := []struct {
+		name    string
+		entries []string
+		changed map[RunState]ExitAction
+		err     bool
+	}{
+		{
+			name:    "default",
+			entries: nil,
+		},
+		{
+			name:    "overrides",
+			entries: []string{"reboot-needed=reboot", " audit-failure = success "},
+			changed: map[RunState]ExitAction{
+				StateRebootNeeded: ActionReboot,
+				StateAuditFailure: ActionSuccess,
+			},
+		},
+		{
+			name:    "later entry wins",
+			entries: []string{"reboot-now=fail", "reboot-now=reboot"},
+			changed: map[RunState]ExitAction{StateRebootNow: ActionReboot},
+		},
+		{name: "no separator", entries: []string{"reboot-needed"}, err: true},
+		{name: "unknown state", entries: []string{"exploded=fail"}, err: true},
+		{name: "success state", entries: []string{"success=fail"}, err: true},
+		{name: "unknown action", entries: []string{"failed=retry"}, err: true},
+		{name: "timed out state", entries: []string{"timed-out=success"}, err: true},
+		{name: "cancelled state", entries: []string{"cancelled=success"}, err: true},
+		{name: "connection error state", entries: []string{"connection-error=reboot"}, err: true},
+		{name: "empty action", entries: []string{"failed="}, err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			policy, err := parseExitPolicy(c.entries)
+			if (err != nil) != c.err {
+				t.Fatalf("error = %v, want error: %t", err, c.err)
+			}
+			if c.err {
+				return
+			}
+
+			if len(policy) != len(defaultExitPolicy) {
+				t.Errorf("policy has %d states, want %d", len(policy), len(defaultExitPolicy))
+			}
+			for state, want := range defaultExitPolicy {
+				if action, ok := c.changed[state]; ok {
+					want = action
+				}
+				if policy[state] != want {
+					t.Errorf("policy[%s] = %q, want %q", state, policy[state], want)
+				}
+			}
+		})
+	}
+}
+
+func TestStateForExitStatus(t *testing.T) {
+	cases := []struct {
+		status int
+		state  RunState
+	}{
+		{0, StateSuccess},
+		{1, StateFailed},
+		{2, StateInterrupted},
+		{3, StateInterrupted},
+		{35, StateRebootScheduled},
+		{37, StateRebootNeeded},
+		{40, StateRebootNow},
+		{41, StateRebootFailed},
+		{42, StateAuditFailure},
+		{213, StateClientUpgrade},
+		{36, StateFailed},
+		{255, StateFailed},
+	}
+
+	for _, c := range cases {
+		if state := stateForExitStatus(c.status); state != c.state {
+			t.Errorf("stateForExitStatus(%d) = %s, want %s", c.status, state, c.state)
+		}
+	}
+}
+
+func TestClassifyRun(t *testing.T) {
+	cases := []struct {
+		name  string
+		err   error
+		state RunState
+
+		// outside is set for states the exit code policy does not apply to
+		outside bool
+	}{
+		{name: "success", state: StateSuccess},
+		{name: "failed", err: &ssh.ExitError{ExitStatus: 1}, state: StateFailed},
+		{name: "reboot scheduled", err: &ssh.ExitError{ExitStatus: 35}, state: StateRebootScheduled},
+		{name: "reboot needed", err: &ssh.ExitError{ExitStatus: 37}, state: StateRebootNeeded},
+		{name: "client upgrade", err: &ssh.ExitError{ExitStatus: 213}, state: StateClientUpgrade},
+		{
+			name:    "timed out",
+			err:     &ssh.ExitError{ExitStatus: 143, Err: context.DeadlineExceeded, TimedOut: true},
+			state:   StateTimedOut,
+			outside: true,
+		},
+		{
+			name:    "cancelled",
+			err:     &ssh.ExitError{ExitStatus: 143, Err: context.Canceled, Cancelled: true},
+			state:   StateCancelled,
+			outside: true,
+		},
+		{name: "cancelled before start", err: context.Canceled, state: StateCancelled, outside: true},
+		{
+			name:    "connection lost",
+			err:     &ssh.ExitError{Err: errors.New("connection to web1 lost: no reply to 3 keepalives sent 15s apart")},
+			state:   StateConnectionError,
+			outside: true,
+		},
+		{
+			name:    "session failed to open",
+			err:     errors.New("error executing remote command: EOF"),
+			state:   StateConnectionError,
+			outside: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			state := classifyRun(c.err)
+			if state != c.state {
+				t.Fatalf("state = %s, want %s", state, c.state)
+			}
+			if state.hasExitCode() == c.outside {
+				t.Errorf("hasExitCode = %t, want %t", state.hasExitCode(), !c.outside)
+			}
+		})
+	}
+}
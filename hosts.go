@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	ssh "github.com/zywillc/drone-chef-client/ssh"
+)
+
+// Target is a single node to converge. Empty fields fall back to the
+// plugin-wide connection settings.
+type Target struct {
+	Host       string `json:"host"`
+	User       string `json:"user"`
+	Port       int    `json:"port"`
+	Password   string `json:"password"`
+	PrivateKey string `json:"private_key"`
+
+	PrivateKeyPassphrase string `json:"private_key_passphrase"`
+	PrivateKeyCert       string `json:"private_key_cert"`
+
+	// HostKey, HostKeyMode and KnownHosts verify this target. When either
+	// key setting is given, the plugin-wide ones are not used for it.
+	HostKey     string `json:"host_key"`
+	HostKeyMode string `json:"host_key_mode"`
+	KnownHosts  string `json:"known_hosts"`
+}
+
+// parseTargets parses the hosts setting. It accepts either a JSON list whose
+// entries are strings or Target objects, or a comma or newline separated list
+// of [user@]host[:port] entries.
+func parseTargets(raw string) ([]Target, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+
+	if !ssh.IsJSONList(raw) {
+		var targets []Target
+		for _, s := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == '\n' }) {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			t, err := parseTarget(s)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, t)
+		}
+		return targets, nil
+	}
+
+	var entries []json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+		return nil, fmt.Errorf("invalid hosts list: %s", err)
+	}
+
+	targets := make([]Target, 0, len(entries))
+	for _, e := range entries {
+		var s string
+		if err := json.Unmarshal(e, &s); err == nil {
+			t, err := parseTarget(s)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, t)
+			continue
+		}
+
+		var t Target
+		if err := json.Unmarshal(e, &t); err != nil {
+			return nil, fmt.Errorf("invalid hosts entry %s: %s", e, err)
+		}
+		if t.Host == "" {
+			return nil, fmt.Errorf("invalid hosts entry %s: missing host", e)
+		}
+		targets = append(targets, t)
+	}
+
+	return targets, nil
+}
+
+// parseTarget parses a [user@]host[:port] entry.
+func parseTarget(s string) (Target, error) {
+	user, host, port, err := ssh.ParseAddress(s)
+	if err != nil {
+		return Target{}, fmt.Errorf("invalid hosts entry: %s", err)
+	}
+	return Target{Host: host, User: user, Port: port}, nil
+}
+
+// withTarget returns a copy of the config pointed at the given target.
+func (c Config) withTarget(t Target) Config {
+	c.Host = t.Host
+	if t.User != "" {
+		c.User = t.User
+	}
+	if t.Port != 0 {
+		c.Port = t.Port
+	}
+	if t.Password != "" {
+		c.Password = t.Password
+	}
+	if t.PrivateKey != "" {
+		c.Private_Key = t.PrivateKey
+		c.Private_Key_Passphrase = t.PrivateKeyPassphrase
+		c.Private_Key_Cert = t.PrivateKeyCert
+	}
+	if t.HostKey != "" || t.KnownHosts != "" {
+		c.Host_Key = t.HostKey
+		c.Host_Key_Mode = t.HostKeyMode
+		c.Known_Hosts = t.KnownHosts
+	}
+	return c
+}
+
+// hostResult records the outcome of converging a single target.
+type hostResult struct {
+	Host     string
+	Err      error
+	Duration time.Duration
+
+	// Skipped is set for hosts never attempted because the rollout stopped
+	Skipped bool
+
+	// Cancelled is set for hosts whose run was stopped by a cancelled build
+	Cancelled bool
+
+	// State is the outcome of the chef-client run, if it ran
+	State RunState
+
+	// Reboots counts the reboots done on behalf of the run
+	Reboots int
+
+	// Pending lists the resources a why-run would change
+	Pending []pendingChange
+}
+
+// converge runs chef-client on every target, with at most parallelism
+// sessions open at once. Results are returned in target order. Targets not
+// yet started when ctx is cancelled are skipped.
+func (p Plugin) converge(ctx context.Context, targets []Target) []hostResult {
+	parallelism := p.Config.parallelism
+	if parallelism <= 0 || parallelism > len(targets) {
+		parallelism = len(targets)
+	}
+
+	results := make([]hostResult, len(targets))
+	sem := make(chan struct{}, parallelism)
+
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			copy(results[i:], skipped(targets[i:]))
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, t Target) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			start := time.Now()
+			res := hostResult{Host: t.Host}
+			res.Err = p.runHost(ctx, t, &res)
+			res.Duration = time.Since(start)
+			res.Cancelled = res.Err != nil && ctx.Err() != nil
+			results[i] = res
+		}(i, t)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// printSummary writes a table with the outcome for every host.
+func printSummary(w io.Writer, results []hostResult) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tSTATUS\tDURATION\tERROR")
+	for _, r := range results {
+		status, msg := "ok", ""
+		switch {
+		case r.Skipped:
+			status = "skipped"
+		case r.Cancelled:
+			status, msg = "cancelled", r.Err.Error()
+		case r.Err != nil:
+			status, msg = "failed", r.Err.Error()
+		case r.State != StateSuccess:
+			status = fmt.Sprintf("ok (%s)", r.State)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Host, status, r.Duration.Round(time.Second), msg)
+	}
+	tw.Flush()
+}
+
+// failures returns the number of results that failed.
+func failures(results []hostResult) int {
+	n := 0
+	for _, r := range results {
+		if r.Err != nil {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTargets(t *testing.T) {
+	cases := []struct {
+		name    string
+		raw     string
+		targets []Target
+		err     bool
+	}{
+		{
+			name: "empty",
+			raw:  " \n",
+		},
+		{
+			name: "shorthand",
+			raw:  "web1, deploy@web2:2222\nweb3,",
+			targets: []Target{
+				{Host: "web1"},
+				{Host: "web2", User: "deploy", Port: 2222},
+				{Host: "web3"},
+			},
+		},
+		{
+			name: "shorthand starting with an ipv6 address",
+			raw:  "[fe80::1]:2222,web2",
+			targets: []Target{
+				{Host: "fe80::1", Port: 2222},
+				{Host: "web2"},
+			},
+		},
+		{
+			name:    "single ipv6 address",
+			raw:     "[fe80::1]",
+			targets: []Target{{Host: "fe80::1"}},
+		},
+		{
+			name: "json strings",
+			raw:  `["web1", "deploy@[fe80::1]:2222"]`,
+			targets: []Target{
+				{Host: "web1"},
+				{Host: "fe80::1", User: "deploy", Port: 2222},
+			},
+		},
+		{
+			name: "json objects",
+			raw:  `[{"host": "web1", "host_key": "SHA256:abc"}, {"host": "web2", "port": 2222, "known_hosts": "/etc/ssh/web2_known_hosts"}]`,
+			targets: []Target{
+				{Host: "web1", HostKey: "SHA256:abc"},
+				{Host: "web2", Port: 2222, KnownHosts: "/etc/ssh/web2_known_hosts"},
+			},
+		},
+		{
+			name:    "empty json list",
+			raw:     "[]",
+			targets: []Target{},
+		},
+		{name: "invalid json", raw: `[{"host": "web1"`, err: true},
+		{name: "json object without host", raw: `[{"user": "deploy"}]`, err: true},
+		{name: "invalid entry", raw: "web1,web2:ssh", err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			targets, err := parseTargets(c.raw)
+			if (err != nil) != c.err {
+				t.Fatalf("error = %v, want error: %t", err, c.err)
+			}
+			if !reflect.DeepEqual(targets, c.targets) {
+				t.Errorf("targets = %+v, want %+v", targets, c.targets)
+			}
+		})
+	}
+}
+
+func TestWithTargetHostKey(t *testing.T) {
+	fleet := Config{Host_Key: "SHA256:fleet", Host_Key_Mode: "fingerprint", Known_Hosts: "/etc/ssh/known_hosts"}
+
+	cases := []struct {
+		name       string
+		target     Target
+		hostKey    string
+		mode       string
+		knownHosts string
+	}{
+		{
+			name:       "plugin-wide",
+			target:     Target{Host: "web1"},
+			hostKey:    "SHA256:fleet",
+			mode:       "fingerprint",
+			knownHosts: "/etc/ssh/known_hosts",
+		},
+		{
+			name:    "host key",
+			target:  Target{Host: "web1", HostKey: "ssh-ed25519 AAAA"},
+			hostKey: "ssh-ed25519 AAAA",
+		},
+		{
+			name:       "known hosts",
+			target:     Target{Host: "web1", KnownHosts: "/etc/ssh/web1_known_hosts"},
+			knownHosts: "/etc/ssh/web1_known_hosts",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := fleet.withTarget(c.target)
+			if conf.Host_Key != c.hostKey || conf.Host_Key_Mode != c.mode || conf.Known_Hosts != c.knownHosts {
+				t.Errorf("host key %q, mode %q, known_hosts %q, want %q, %q, %q",
+					conf.Host_Key, conf.Host_Key_Mode, conf.Known_Hosts, c.hostKey, c.mode, c.knownHosts)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+
+	ssh "github.com/zywillc/drone-chef-client/ssh"
+)
+
+// DefaultCookbookPath is the workspace directory uploaded in local mode if
+// there is no cookbook path given
+const DefaultCookbookPath = "cookbooks"
+
+// repoLayout is how the cookbook path of a local mode run is laid out.
+type repoLayout int
+
+const (
+	// layoutCookbooks is a directory of cookbooks, such as the output of
+	// `berks vendor`
+	layoutCookbooks repoLayout = iota
+
+	// layoutCookbook is a single cookbook
+	layoutCookbook
+
+	// layoutExport is the output of `chef export`, which carries its own
+	// .chef/config.rb
+	layoutExport
+)
+
+// localRepoLayout inspects the cookbook path in the workspace.
+func localRepoLayout(dir string) (repoLayout, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cookbook path: %s", err)
+	}
+	if !info.IsDir() {
+		return 0, fmt.Errorf("invalid cookbook path %q: not a directory", dir)
+	}
+
+	switch {
+	case fileExists(filepath.Join(dir, ".chef", "config.rb")):
+		return layoutExport, nil
+	case fileExists(filepath.Join(dir, "metadata.rb")), fileExists(filepath.Join(dir, "metadata.json")):
+		return layoutCookbook, nil
+	}
+	return layoutCookbooks, nil
+}
+
+// uploadLocalRepo creates a private chef repo in a temporary directory on
+// the target, fills it from the policy archive or the cookbook path and
+// returns its path.
+func (r *remote) uploadLocalRepo() (string, error) {
+	repo := remoteTempPath("drone-chef-repo", "")
+	if err := r.run("mkdir -m 700 "+ssh.ShellQuote(repo), nil); err != nil {
+		return "", fmt.Errorf("error creating %s: %s", repo, err)
+	}
+
+	var err error
+	if r.conf.policyArchive != "" {
+		err = r.uploadPolicyArchive(repo)
+	} else {
+		err = r.uploadCookbooks(repo)
+	}
+	if err != nil {
+		r.cleanup("rm -rf "+ssh.ShellQuote(repo), false)
+		return "", err
+	}
+
+	return repo, nil
+}
+
+// uploadCookbooks uploads the cookbook path into repo, according to its
+// layout.
+func (r *remote) uploadCookbooks(repo string) error {
+	src := r.conf.cookbookPath
+	layout, err := localRepoLayout(src)
+	if err != nil {
+		return err
+	}
+
+	dst := repo
+	switch layout {
+	case layoutCookbooks:
+		dst = path.Join(repo, "cookbooks")
+	case layoutCookbook:
+		abs, err := filepath.Abs(src)
+		if err != nil {
+			return err
+		}
+		dst = path.Join(repo, "cookbooks", filepath.Base(abs))
+	}
+
+	log.Printf("%s: uploading %s to %s", r.connInfo.Host, src, dst)
+	if err := r.comm.UploadDir(r.ctx, dst, src); err != nil {
+		return fmt.Errorf("error uploading cookbooks: %s", err)
+	}
+	return nil
+}
+
+// inDir wraps a command so that it runs in dir. chef-client finds the
+// cookbooks and any .chef/config.rb of a local mode repo from its working
+// directory.
+func inDir(dir, command string) string {
+	return "sh -c " + ssh.ShellQuote("cd "+ssh.ShellQuote(dir)+" && exec "+command)
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
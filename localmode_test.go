@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalRepoLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drone-chef-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		"cookbooks/base/metadata.rb",
+		"cookbook/metadata.rb",
+		"json-cookbook/metadata.json",
+		"export/.chef/config.rb",
+		"export/cookbook_artifacts/base-1a2b/metadata.json",
+		"file",
+	}
+	for _, f := range files {
+		p := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("cookbook", filepath.Join(dir, "linked")); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		path   string
+		layout repoLayout
+		err    bool
+	}{
+		{path: "cookbooks", layout: layoutCookbooks},
+		{path: "cookbook", layout: layoutCookbook},
+		{path: "json-cookbook", layout: layoutCookbook},
+		{path: "export", layout: layoutExport},
+		{path: "linked", layout: layoutCookbook},
+		{path: "file", err: true},
+		{path: "missing", err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			layout, err := localRepoLayout(filepath.Join(dir, c.path))
+			if (err != nil) != c.err {
+				t.Fatalf("error = %v, want error: %t", err, c.err)
+			}
+			if !c.err && layout != c.layout {
+				t.Errorf("layout = %d, want %d", layout, c.layout)
+			}
+		})
+	}
+}
+
+func TestInDir(t *testing.T) {
+	cases := []struct {
+		name    string
+		dir     string
+		command string
+		want    string
+	}{
+		{
+			name:    "plain",
+			dir:     "/var/tmp/drone-chef-repo-1a2b",
+			command: "chef-client -z",
+			want:    `sh -c 'cd '\''/var/tmp/drone-chef-repo-1a2b'\'' && exec chef-client -z'`,
+		},
+		{
+			name:    "quoted command",
+			dir:     "/var/tmp/repo",
+			command: "chef-client -z -o 'recipe[base]'",
+			want:    `sh -c 'cd '\''/var/tmp/repo'\'' && exec chef-client -z -o '\''recipe[base]'\'''`,
+		},
+		{
+			name:    "dir with shell syntax",
+			dir:     "/var/tmp/a b;$(reboot)",
+			command: "chef-client -z",
+			want:    `sh -c 'cd '\''/var/tmp/a b;$(reboot)'\'' && exec chef-client -z'`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := inDir(c.dir, c.command); got != c.want {
+				t.Errorf("command =\n%s\nwant\n%s", got, c.want)
+			}
+		})
+	}
+}
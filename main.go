@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"log"
 	"errors"
 
@@ -38,6 +41,31 @@ func main() {
 			Usage:  "ssh private key",
 			EnvVar: "PLUGIN_PRIVATE_KEY, SSH_PRIVATE_KEY",
 		},
+		cli.StringFlag{
+			Name:   "private-key-passphrase",
+			Usage:  "ssh private key passphrase",
+			EnvVar: "PLUGIN_PRIVATE_KEY_PASSPHRASE, SSH_PRIVATE_KEY_PASSPHRASE",
+		},
+		cli.StringFlag{
+			Name:   "totp-secret",
+			Usage:  "base32 TOTP secret answering keyboard-interactive one-time code prompts",
+			EnvVar: "PLUGIN_TOTP_SECRET, SSH_TOTP_SECRET",
+		},
+		cli.StringFlag{
+			Name:   "password-prompt",
+			Usage:  "regular expression matching keyboard-interactive password prompts",
+			EnvVar: "PLUGIN_PASSWORD_PROMPT",
+		},
+		cli.StringFlag{
+			Name:   "otp-prompt",
+			Usage:  "regular expression matching keyboard-interactive one-time code prompts",
+			EnvVar: "PLUGIN_OTP_PROMPT",
+		},
+		cli.StringFlag{
+			Name:   "private-key-cert",
+			Usage:  "ssh user certificate signed for the private key",
+			EnvVar: "PLUGIN_PRIVATE_KEY_CERT, SSH_PRIVATE_KEY_CERT",
+		},
 		cli.StringFlag{
 			Name:   "host",
 			Usage:  "ssh host ip",
@@ -59,9 +87,14 @@ func main() {
 			EnvVar: "PLUGIN_AGENT",
 		},
 		cli.StringFlag{
-			Name:   "timeout",
-			Usage:  "ssh timeout",
-			EnvVar: "PLUGIN_TIMEOUT",
+			Name:   "connect-timeout, timeout",
+			Usage:  "ssh connection timeout, including retries",
+			EnvVar: "PLUGIN_CONNECT_TIMEOUT,PLUGIN_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "run-timeout",
+			Usage:  "maximum duration of a remote command before it is stopped",
+			EnvVar: "PLUGIN_RUN_TIMEOUT",
 		},
 		cli.StringFlag{
 			Name:   "bastion-user",
@@ -74,10 +107,15 @@ func main() {
 			EnvVar: "PLUGIN_BASTION_PASSWORD",
 		},
 		cli.StringFlag{
-			Name:   "bastion private key",
+			Name:   "bastion-private-key",
 			Usage:  "ssh bastion private key",
 			EnvVar: "PLUGIN_BASTION_PRIVATE_KEY, SSH_BASTION_PRIVATE_KEY",
 		},
+		cli.StringFlag{
+			Name:   "bastion-private-key-passphrase",
+			Usage:  "ssh bastion private key passphrase",
+			EnvVar: "PLUGIN_BASTION_PRIVATE_KEY_PASSPHRASE, SSH_BASTION_PRIVATE_KEY_PASSPHRASE",
+		},
 		cli.StringFlag{
 			Name:   "bastion-host",
 			Usage:  "ssh bastion host ip",
@@ -94,10 +132,58 @@ func main() {
 			EnvVar: "PLUGIN_BASTION_PORT",
 		},
 		cli.StringFlag{
-			Name:   "agent-indentity",
+			Name:   "bastion-known-hosts",
+			Usage:  "path to a known_hosts file used to verify the bastion, defaults to known-hosts",
+			EnvVar: "PLUGIN_BASTION_KNOWN_HOSTS, SSH_BASTION_KNOWN_HOSTS",
+		},
+		cli.StringFlag{
+			Name:   "bastion-host-key-mode",
+			Usage:  "how bastion-host-key is interpreted: auto, key, fingerprint or ca",
+			Value:  "auto",
+			EnvVar: "PLUGIN_BASTION_HOST_KEY_MODE",
+		},
+		cli.StringFlag{
+			Name:   "ssh-config",
+			Usage:  "path to, or contents of, an OpenSSH client config used to resolve hosts",
+			EnvVar: "PLUGIN_SSH_CONFIG, SSH_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "keepalive-interval",
+			Usage:  "interval between ssh keepalive requests, disabled when unset",
+			EnvVar: "PLUGIN_KEEPALIVE_INTERVAL",
+		},
+		cli.IntFlag{
+			Name:   "keepalive-max-missed",
+			Usage:  "unanswered keepalives after which the connection is considered dead",
+			Value:  3,
+			EnvVar: "PLUGIN_KEEPALIVE_MAX_MISSED",
+		},
+		cli.StringFlag{
+			Name:   "jump-hosts",
+			Usage:  "ordered jump hosts as user@host:port,user@host:port or a JSON list, replaces the bastion",
+			EnvVar: "PLUGIN_JUMP_HOSTS",
+		},
+		cli.StringFlag{
+			Name:   "agent-identity",
 			Usage:  "ssh agent identity",
 			EnvVar: "PLUGIN_AGENT_IDENTITY, SSH_AGENT_IDENTITY",
 		},
+		cli.StringFlag{
+			Name:   "known-hosts",
+			Usage:  "path to a known_hosts file used to verify hosts",
+			EnvVar: "PLUGIN_KNOWN_HOSTS, SSH_KNOWN_HOSTS",
+		},
+		cli.StringFlag{
+			Name:   "host-key-mode",
+			Usage:  "how host-key is interpreted: auto, key, fingerprint or ca",
+			Value:  "auto",
+			EnvVar: "PLUGIN_HOST_KEY_MODE",
+		},
+		cli.BoolFlag{
+			Name:   "strict-host-key-checking",
+			Usage:  "refuse to connect when no host key or known_hosts file is given",
+			EnvVar: "PLUGIN_STRICT_HOST_KEY_CHECKING",
+		},
 		cli.StringSliceFlag{
 			Name: "run-list",
 			Usage: "chef client run list",
@@ -108,6 +194,205 @@ func main() {
 			Usage: "chef client sudo password",
 			EnvVar: "PLUGIN_SUDO_PASSWORD, CHEF_CLIENT_SUDO_PASSWORD, SUDO_PASSWORD",
 		},
+		cli.BoolFlag{
+			Name:   "output-prefix",
+			Usage:  "prefix each line of remote output with the host",
+			EnvVar: "PLUGIN_OUTPUT_PREFIX",
+		},
+		cli.BoolFlag{
+			Name:   "output-timestamps",
+			Usage:  "prefix each line of remote output with a timestamp",
+			EnvVar: "PLUGIN_OUTPUT_TIMESTAMPS",
+		},
+		cli.StringFlag{
+			Name:   "hosts",
+			Usage:  "list of hosts to converge, each optionally overriding user, port, key and host key",
+			EnvVar: "PLUGIN_HOSTS",
+		},
+		cli.IntFlag{
+			Name:   "parallelism",
+			Usage:  "maximum number of hosts converged at once",
+			Value:  1,
+			EnvVar: "PLUGIN_PARALLELISM",
+		},
+		cli.StringFlag{
+			Name:   "batch-size",
+			Usage:  "number or percentage of hosts converged per rollout batch",
+			EnvVar: "PLUGIN_BATCH_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "batch-pause",
+			Usage:  "time to wait between rollout batches",
+			EnvVar: "PLUGIN_BATCH_PAUSE",
+		},
+		cli.IntFlag{
+			Name:   "max-failures",
+			Usage:  "number of failed hosts tolerated before later batches are skipped",
+			EnvVar: "PLUGIN_MAX_FAILURES",
+		},
+		cli.IntFlag{
+			Name:   "max-failure-percentage",
+			Usage:  "percentage of failed hosts tolerated before later batches are skipped",
+			EnvVar: "PLUGIN_MAX_FAILURE_PERCENTAGE",
+		},
+		cli.StringSliceFlag{
+			Name:   "canary-hosts",
+			Usage:  "hosts converged before the rest of the fleet, as [user@]host[:port] or an ssh config alias",
+			EnvVar: "PLUGIN_CANARY_HOSTS",
+		},
+		cli.IntFlag{
+			Name:   "canary-count",
+			Usage:  "number of leading hosts used as canaries when canary-hosts is not set",
+			EnvVar: "PLUGIN_CANARY_COUNT",
+		},
+		cli.StringFlag{
+			Name:   "canary-verify",
+			Usage:  "command run on every canary after its converge, the fleet only proceeds if it succeeds",
+			EnvVar: "PLUGIN_CANARY_VERIFY",
+		},
+		cli.StringFlag{
+			Name:   "environment",
+			Usage:  "chef environment",
+			EnvVar: "PLUGIN_ENVIRONMENT",
+		},
+		cli.StringFlag{
+			Name:   "json-attributes",
+			Usage:  "inline JSON attributes, or a path or URL on the node",
+			EnvVar: "PLUGIN_JSON_ATTRIBUTES",
+		},
+		cli.StringSliceFlag{
+			Name:   "override-runlist",
+			Usage:  "chef client override run list",
+			EnvVar: "PLUGIN_OVERRIDE_RUNLIST",
+		},
+		cli.StringFlag{
+			Name:   "named-run-list",
+			Usage:  "policyfile named run list",
+			EnvVar: "PLUGIN_NAMED_RUN_LIST",
+		},
+		cli.StringFlag{
+			Name:   "log-level",
+			Usage:  "chef client log level",
+			EnvVar: "PLUGIN_LOG_LEVEL",
+		},
+		cli.BoolFlag{
+			Name:   "why-run",
+			Usage:  "run chef client in why-run mode",
+			EnvVar: "PLUGIN_WHY_RUN",
+		},
+		cli.StringFlag{
+			Name:   "why-run-report",
+			Usage:  "file the pending changes found by a why-run are written to as JSON",
+			EnvVar: "PLUGIN_WHY_RUN_REPORT",
+		},
+		cli.BoolFlag{
+			Name:   "force-formatter",
+			Usage:  "use the formatter output even when not attached to a console",
+			EnvVar: "PLUGIN_FORCE_FORMATTER",
+		},
+		cli.StringFlag{
+			Name:   "chef-license",
+			Usage:  "chef license acceptance (accept, accept-silent or accept-no-persist)",
+			EnvVar: "PLUGIN_CHEF_LICENSE",
+		},
+		cli.StringFlag{
+			Name:   "node-name",
+			Usage:  "chef node name",
+			EnvVar: "PLUGIN_NODE_NAME",
+		},
+		cli.StringSliceFlag{
+			Name:   "extra-args",
+			Usage:  "additional chef client arguments",
+			EnvVar: "PLUGIN_EXTRA_ARGS",
+		},
+		cli.StringSliceFlag{
+			Name:   "exit-code-policy",
+			Usage:  "state=action overrides for chef client exit codes, action is success, fail or reboot",
+			EnvVar: "PLUGIN_EXIT_CODE_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "reboot-command",
+			Usage:  "command run as root to reboot a node that needs it",
+			Value:  "shutdown -r now",
+			EnvVar: "PLUGIN_REBOOT_COMMAND",
+		},
+		cli.StringFlag{
+			Name:   "reboot-timeout",
+			Usage:  "how long to wait for a node to come back after a reboot",
+			EnvVar: "PLUGIN_REBOOT_TIMEOUT",
+		},
+		cli.BoolFlag{
+			Name:   "reboot-rerun",
+			Usage:  "run chef client again once a node is back from a reboot",
+			EnvVar: "PLUGIN_REBOOT_RERUN",
+		},
+		cli.BoolFlag{
+			Name:   "local-mode",
+			Usage:  "run chef client in local mode against cookbooks uploaded from the workspace",
+			EnvVar: "PLUGIN_LOCAL_MODE",
+		},
+		cli.StringFlag{
+			Name:   "cookbook-path",
+			Usage:  "workspace directory uploaded in local mode: a cookbook, a directory of cookbooks or a chef export directory",
+			Value:  DefaultCookbookPath,
+			EnvVar: "PLUGIN_COOKBOOK_PATH",
+		},
+		cli.StringFlag{
+			Name:   "policy-name",
+			Usage:  "chef client policy name, instead of a run list",
+			EnvVar: "PLUGIN_POLICY_NAME",
+		},
+		cli.StringFlag{
+			Name:   "policy-group",
+			Usage:  "chef client policy group",
+			EnvVar: "PLUGIN_POLICY_GROUP",
+		},
+		cli.StringFlag{
+			Name:   "policy-archive",
+			Usage:  "workspace path of a chef export --archive tarball to converge in local mode",
+			EnvVar: "PLUGIN_POLICY_ARCHIVE",
+		},
+		cli.BoolFlag{
+			Name:   "write-client-rb",
+			Usage:  "render client.rb from the plugin settings and write it to the node before the run, a why-run only reads it from a temp file; not supported in local mode or with a policy archive",
+			EnvVar: "PLUGIN_WRITE_CLIENT_RB",
+		},
+		cli.StringFlag{
+			Name:   "client-rb-path",
+			Usage:  "path of the rendered client.rb on the node",
+			Value:  DefaultClientRBPath,
+			EnvVar: "PLUGIN_CLIENT_RB_PATH",
+		},
+		cli.StringFlag{
+			Name:   "chef-server-url",
+			Usage:  "client.rb chef_server_url",
+			EnvVar: "PLUGIN_CHEF_SERVER_URL",
+		},
+		cli.StringFlag{
+			Name:   "ssl-verify-mode",
+			Usage:  "client.rb ssl_verify_mode, verify_peer or verify_none",
+			EnvVar: "PLUGIN_SSL_VERIFY_MODE",
+		},
+		cli.StringFlag{
+			Name:   "log-location",
+			Usage:  "client.rb log_location, a path, STDOUT, STDERR or syslog",
+			EnvVar: "PLUGIN_LOG_LOCATION",
+		},
+		cli.StringFlag{
+			Name:   "file-cache-path",
+			Usage:  "client.rb file_cache_path",
+			EnvVar: "PLUGIN_FILE_CACHE_PATH",
+		},
+		cli.StringFlag{
+			Name:   "proxy",
+			Usage:  "client.rb http_proxy and https_proxy",
+			EnvVar: "PLUGIN_PROXY",
+		},
+		cli.StringFlag{
+			Name:   "client-rb-extra",
+			Usage:  "additional ruby appended verbatim to client.rb",
+			EnvVar: "PLUGIN_CLIENT_RB_EXTRA",
+		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -121,25 +406,99 @@ func run(c *cli.Context) error{
 			User: 						c.String("user"),
 			Password: 					c.String("password"),
 			Private_Key: 				c.String("private-key"),
+			Private_Key_Passphrase:		c.String("private-key-passphrase"),
+			Private_Key_Cert:			c.String("private-key-cert"),
 			Host: 						c.String("host"),
 			Host_Key:					c.String("host-key"),
 			Port:						c.Int("port"),
 			Agent:						c.Bool("agent"),
-			Timeout:					c.String("timeout"),
+			Timeout:					c.String("connect-timeout"),
+			Run_Timeout:				c.String("run-timeout"),
 			Bastion_User:				c.String("bastion-user"),
 			Bastion_Password:			c.String("bastion-password"),
 			Bastion_Private_Key:		c.String("bastion-private-key"),
+			Bastion_Private_Key_Passphrase:	c.String("bastion-private-key-passphrase"),
+			Bastion_Host:				c.String("bastion-host"),
 			Bastion_Host_Key:			c.String("bastion-host-key"),
 			Bastion_Port:				c.Int("bastion-port"),
+			Bastion_Known_Hosts:		c.String("bastion-known-hosts"),
+			Bastion_Host_Key_Mode:		c.String("bastion-host-key-mode"),
 			Agent_Identity:				c.String("agent-identity"),
+			Known_Hosts:				c.String("known-hosts"),
+			Host_Key_Mode:				c.String("host-key-mode"),
+			Strict_Host_Key_Checking:	c.Bool("strict-host-key-checking"),
+			TOTP_Secret:				c.String("totp-secret"),
+			Password_Prompt:			c.String("password-prompt"),
+			OTP_Prompt:					c.String("otp-prompt"),
+			jumpHosts:					c.String("jump-hosts"),
+			sshConfigSetting:			c.String("ssh-config"),
+			keepaliveInterval:			safeDuration(c.String("keepalive-interval"), 0),
+			keepaliveMaxMissed:			c.Int("keepalive-max-missed"),
 			runList:					c.StringSlice("run-list"),
 			sudopwd:					c.String("sudo-password"),
+			outputPrefix:				c.Bool("output-prefix"),
+			outputTimestamps:			c.Bool("output-timestamps"),
+			hosts:						c.String("hosts"),
+			parallelism:				c.Int("parallelism"),
+			batchSize:					c.String("batch-size"),
+			batchPause:					safeDuration(c.String("batch-pause"), 0),
+			maxFailures:				c.Int("max-failures"),
+			maxFailurePercentage:		c.Int("max-failure-percentage"),
+			canaryHosts:				c.StringSlice("canary-hosts"),
+			canaryCount:				c.Int("canary-count"),
+			canaryVerify:				c.String("canary-verify"),
+			environment:				c.String("environment"),
+			jsonAttributes:				c.String("json-attributes"),
+			overrideRunList:			c.StringSlice("override-runlist"),
+			namedRunList:				c.String("named-run-list"),
+			logLevel:					c.String("log-level"),
+			whyRun:						c.Bool("why-run"),
+			whyRunReport:				c.String("why-run-report"),
+			forceFormatter:				c.Bool("force-formatter"),
+			chefLicense:				c.String("chef-license"),
+			nodeName:					c.String("node-name"),
+			extraArgs:					c.StringSlice("extra-args"),
+			exitCodePolicy:				c.StringSlice("exit-code-policy"),
+			rebootCommand:				c.String("reboot-command"),
+			rebootTimeout:				safeDuration(c.String("reboot-timeout"), DefaultRebootTimeout),
+			rebootRerun:				c.Bool("reboot-rerun"),
+			localMode:					c.Bool("local-mode"),
+			cookbookPath:				c.String("cookbook-path"),
+			policyName:					c.String("policy-name"),
+			policyGroup:				c.String("policy-group"),
+			policyArchive:				c.String("policy-archive"),
+			writeClientRB:				c.Bool("write-client-rb"),
+			clientRBPath:				c.String("client-rb-path"),
+			chefServerURL:				c.String("chef-server-url"),
+			sslVerifyMode:				c.String("ssl-verify-mode"),
+			logLocation:				c.String("log-location"),
+			fileCachePath:				c.String("file-cache-path"),
+			proxy:						c.String("proxy"),
+			clientRBExtra:				c.String("client-rb-extra"),
 		},
 	}
 
-	if err := plugin.Exec(); err != nil {
+	if err := plugin.Exec(withCancelSignals()); err != nil {
 		return errors.New(fmt.Sprintf("Excecuting plugin fails: %s", err))
 	}
 
 	return nil
 }
+
+// withCancelSignals returns a context that is cancelled when the plugin
+// receives SIGTERM or SIGINT, as it does when the Drone build is cancelled.
+// Only the first signal is caught, a second one kills the plugin outright.
+func withCancelSignals() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigs
+		signal.Stop(sigs)
+		log.Printf("received %s, cancelling remote commands, signal again to exit now", sig)
+		cancel()
+	}()
+
+	return ctx
+}
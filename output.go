@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// outputMu serializes writes to the plugin's stdout and stderr so that lines
+// coming from concurrent remote sessions never interleave mid-line.
+var outputMu sync.Mutex
+
+// lineWriter forwards remote output to w one complete line at a time,
+// optionally tagging each line with a prefix and a timestamp. Partial lines
+// are held back until their newline arrives or the writer is closed.
+type lineWriter struct {
+	w          io.Writer
+	prefix     string
+	timestamps bool
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func newLineWriter(w io.Writer, prefix string, timestamps bool) *lineWriter {
+	return &lineWriter{
+		w:          w,
+		prefix:     prefix,
+		timestamps: timestamps,
+	}
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := l.writeLine(l.buf[:i]); err != nil {
+			return len(p), err
+		}
+		l.buf = l.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Close flushes any trailing partial line.
+func (l *lineWriter) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.buf) == 0 {
+		return nil
+	}
+	err := l.writeLine(l.buf)
+	l.buf = nil
+	return err
+}
+
+func (l *lineWriter) writeLine(line []byte) error {
+	// output from a pty arrives with CRLF line endings
+	line = bytes.TrimRight(line, "\r")
+
+	var b bytes.Buffer
+	if l.timestamps {
+		b.WriteString(time.Now().Format(time.RFC3339))
+		b.WriteByte(' ')
+	}
+	if l.prefix != "" {
+		fmt.Fprintf(&b, "[%s] ", l.prefix)
+	}
+	b.Write(line)
+	b.WriteByte('\n')
+
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	_, err := l.w.Write(b.Bytes())
+	return err
+}
+
+// syncWriter serializes writes to w, for a writer shared by the stdout and
+// stderr copies of a session, which run in goroutines of their own.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLineWriter(t *testing.T) {
+	cases := []struct {
+		name   string
+		prefix string
+		writes []string
+
+		// held is the output before Close, out the output after it
+		held string
+		out  string
+	}{
+		{
+			name:   "whole lines",
+			writes: []string{"Starting Chef Client\nConverging 3 resources\n"},
+			held:   "Starting Chef Client\nConverging 3 resources\n",
+			out:    "Starting Chef Client\nConverging 3 resources\n",
+		},
+		{
+			name:   "partial lines held until their newline",
+			writes: []string{"Start", "ing Chef", " Client\nConv", "erging"},
+			held:   "Starting Chef Client\n",
+			out:    "Starting Chef Client\nConverging\n",
+		},
+		{
+			name:   "trailing partial line flushed on close",
+			writes: []string{"Chef Client finished"},
+			held:   "",
+			out:    "Chef Client finished\n",
+		},
+		{
+			name:   "crlf from a pty",
+			writes: []string{"Starting Chef Client\r\n", "Converging\r", "\n", "done\r"},
+			held:   "Starting Chef Client\nConverging\n",
+			out:    "Starting Chef Client\nConverging\ndone\n",
+		},
+		{
+			name:   "empty lines kept",
+			writes: []string{"a\n\nb\n"},
+			held:   "a\n\nb\n",
+			out:    "a\n\nb\n",
+		},
+		{
+			name:   "prefix",
+			prefix: "web1",
+			writes: []string{"Starting Chef Client\n", "done"},
+			held:   "[web1] Starting Chef Client\n",
+			out:    "[web1] Starting Chef Client\n[web1] done\n",
+		},
+		{
+			name: "nothing written",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var b bytes.Buffer
+			w := newLineWriter(&b, c.prefix, false)
+			for _, s := range c.writes {
+				n, err := w.Write([]byte(s))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != len(s) {
+					t.Errorf("wrote %d bytes, want %d", n, len(s))
+				}
+			}
+			if got := b.String(); got != c.held {
+				t.Errorf("output before close = %q, want %q", got, c.held)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.String(); got != c.out {
+				t.Errorf("output = %q, want %q", got, c.out)
+			}
+		})
+	}
+}
+
+func TestLineWriterTimestamps(t *testing.T) {
+	var b bytes.Buffer
+	w := newLineWriter(&b, "web1", true)
+
+	before := time.Now().Truncate(time.Second)
+	if _, err := w.Write([]byte("Starting Chef Client\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+
+	// the timestamp comes first, then the host prefix
+	fields := strings.SplitN(b.String(), " ", 2)
+	if len(fields) != 2 {
+		t.Fatalf("output = %q, want a timestamp and a line", b.String())
+	}
+	ts, err := time.Parse(time.RFC3339, fields[0])
+	if err != nil {
+		t.Fatalf("output = %q, want an RFC3339 timestamp first: %s", b.String(), err)
+	}
+	if ts.Before(before) || ts.After(after) {
+		t.Errorf("timestamp = %s, want it between %s and %s", ts, before, after)
+	}
+	if want := "[web1] Starting Chef Client\n"; fields[1] != want {
+		t.Errorf("line = %q, want %q", fields[1], want)
+	}
+}
+
+func TestLineWriterConcurrent(t *testing.T) {
+	const (
+		hosts = 8
+		lines = 50
+	)
+
+	var b bytes.Buffer
+	var wg sync.WaitGroup
+	for h := 0; h < hosts; h++ {
+		wg.Add(1)
+		go func(h int) {
+			defer wg.Done()
+			w := newLineWriter(&b, fmt.Sprintf("web%d", h), false)
+			defer w.Close()
+
+			// dribble the output a few bytes at a time, as a session does
+			for i := 0; i < lines; i++ {
+				line := fmt.Sprintf("line %d of host %d\n", i, h)
+				for len(line) > 0 {
+					n := 3
+					if n > len(line) {
+						n = len(line)
+					}
+					w.Write([]byte(line[:n]))
+					line = line[n:]
+				}
+			}
+		}(h)
+	}
+	wg.Wait()
+
+	got := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(got) != hosts*lines {
+		t.Fatalf("got %d lines, want %d", len(got), hosts*lines)
+	}
+	next := make([]int, hosts)
+	for _, line := range got {
+		var h, i int
+		fmt.Sscanf(line, "[web%d] line %d", &h, &i)
+		if h < 0 || h >= hosts || line != fmt.Sprintf("[web%d] line %d of host %d", h, i, h) {
+			t.Fatalf("interleaved line %q", line)
+		}
+		if i != next[h] {
+			t.Errorf("host %d line %d came out as line %d", h, i, next[h])
+		}
+		next[h] = i + 1
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"io"
 	"strings"
 	"fmt"
 	"os"
@@ -10,6 +12,7 @@ import (
 	"errors"
 
 	"github.com/fatih/structs"
+	sshconfig "github.com/kevinburke/ssh_config"
 	"github.com/mitchellh/mapstructure"
 	ssh "github.com/zywillc/drone-chef-client/ssh"
 )
@@ -21,8 +24,18 @@ const (
 	// DefaultPort is used if there is no port given
 	DefaultPort = 22
 
-	// DefaultTimeout is used if there is no timeout given
+	// DefaultTimeout is used if there is no connect timeout given
 	DefaultTimeout = 5 * time.Minute
+
+	// DefaultRunTimeout is used if there is no run timeout given
+	DefaultRunTimeout = time.Hour
+
+	// sudoPrompt replaces the default sudo prompt so that the password
+	// request is easy to spot in the build log
+	sudoPrompt = "[sudo] chef-client password: "
+
+	// cleanupTimeout bounds a command removing what a run left behind
+	cleanupTimeout = time.Minute
 )
 
 type (
@@ -31,21 +44,93 @@ type (
 		User       string
 		Password   string
 		Private_Key string
+		Private_Key_Passphrase string
+		Private_Key_Cert string
 		Host       string
 		Host_Key    string
 		Port       int
 		Agent      bool
 		Timeout    string
+		Run_Timeout string
 		Bastion_User       string
 		Bastion_Password   string
 		Bastion_Private_Key string
+		Bastion_Private_Key_Passphrase string
 		Bastion_Host       string
 		Bastion_Host_Key    string
 		Bastion_Port       int
+		Bastion_Known_Hosts   string
+		Bastion_Host_Key_Mode string
 		Agent_Identity string
 
+		Known_Hosts              string
+		Host_Key_Mode            string
+		Strict_Host_Key_Checking bool
+
+		TOTP_Secret     string
+		Password_Prompt string
+		OTP_Prompt      string
+
+		jumpHosts         string
+		keepaliveInterval  time.Duration
+		keepaliveMaxMissed int
+
+		sshConfigSetting string
+		sshConfig        *sshconfig.Config
+
 		runList []string
 		sudopwd string
+
+		outputPrefix     bool
+		outputTimestamps bool
+
+		hosts       string
+		parallelism int
+
+		batchSize            string
+		batchPause           time.Duration
+		maxFailures          int
+		maxFailurePercentage int
+
+		canaryHosts  []string
+		canaryCount  int
+		canaryVerify string
+
+		environment     string
+		jsonAttributes  string
+		overrideRunList []string
+		namedRunList    string
+		logLevel        string
+		whyRun          bool
+		whyRunReport    string
+		forceFormatter  bool
+		chefLicense     string
+		nodeName        string
+		extraArgs       []string
+
+		exitCodePolicy []string
+		exitPolicy     map[RunState]ExitAction
+
+		rebootCommand string
+		rebootTimeout time.Duration
+		rebootRerun   bool
+
+		localMode    bool
+		cookbookPath string
+
+		policyName    string
+		policyGroup   string
+		policyArchive string
+		policy        *policyLock
+
+		writeClientRB bool
+		clientRBPath  string
+		chefServerURL string
+		sslVerifyMode string
+		logLocation   string
+		fileCachePath string
+		proxy         string
+		clientRBExtra string
 	}
 
 	Plugin struct {
@@ -91,6 +176,35 @@ func parseConnectionInfo(config *Config) (*ssh.ConnectionInfo, error) {
 	} else {
 		connInfo.TimeoutVal = DefaultTimeout
 	}
+	connInfo.RunTimeoutVal = safeDuration(connInfo.RunTimeout, DefaultRunTimeout)
+
+	connInfo.KeepAliveInterval = config.keepaliveInterval
+	connInfo.KeepAliveMaxMissed = config.keepaliveMaxMissed
+
+	connInfo.JumpHosts, err = ssh.ParseJumpHosts(config.jumpHosts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range connInfo.JumpHosts {
+		j := &connInfo.JumpHosts[i]
+		if j.User == "" {
+			j.User = connInfo.User
+		}
+		if j.Port == 0 {
+			j.Port = DefaultPort
+		}
+		if j.Password == "" {
+			j.Password = connInfo.Password
+		}
+		if j.PrivateKey == "" {
+			j.PrivateKey = connInfo.PrivateKey
+			j.PrivateKeyPassphrase = connInfo.PrivateKeyPassphrase
+		}
+		// like OpenSSH, every hop is looked up in the same known_hosts
+		if j.KnownHosts == "" {
+			j.KnownHosts = connInfo.KnownHosts
+		}
+	}
 
 	// Default all bastion config attrs to their non-bastion counterparts
 	if connInfo.BastionHost != "" {
@@ -103,10 +217,14 @@ func parseConnectionInfo(config *Config) (*ssh.ConnectionInfo, error) {
 		}
 		if connInfo.BastionPrivateKey == "" {
 			connInfo.BastionPrivateKey = connInfo.PrivateKey
+			connInfo.BastionPrivateKeyPassphrase = connInfo.PrivateKeyPassphrase
 		}
 		if connInfo.BastionPort == 0 {
 			connInfo.BastionPort = connInfo.Port
 		}
+		if connInfo.BastionKnownHosts == "" {
+			connInfo.BastionKnownHosts = connInfo.KnownHosts
+		}
 	}
 
 	return connInfo, nil
@@ -114,6 +232,9 @@ func parseConnectionInfo(config *Config) (*ssh.ConnectionInfo, error) {
 
 // safeDuration returns either the parsed duration or a default value
 func safeDuration(dur string, defaultDur time.Duration) time.Duration {
+	if dur == "" {
+		return defaultDur
+	}
 	d, err := time.ParseDuration(dur)
 	if err != nil {
 		log.Printf("Invalid duration '%s', using default of %s", dur, defaultDur)
@@ -124,36 +245,407 @@ func safeDuration(dur string, defaultDur time.Duration) time.Duration {
 
 
 
-// Plugin execution implementation
-func (p Plugin) Exec() error {
-	// plugin logic goes here
-	conf := p.Config
-	connInfo, err := parseConnectionInfo(&conf)
+// Plugin execution implementation. Cancelling ctx stops the remote
+// commands and skips the hosts not yet started.
+func (p Plugin) Exec(ctx context.Context) error {
+	if err := p.Config.validateChefOptions(); err != nil {
+		return err
+	}
+	if err := p.Config.loadPolicyArchive(); err != nil {
+		return err
+	}
+
+	policy, err := parseExitPolicy(p.Config.exitCodePolicy)
 	if err != nil {
 		return err
 	}
+	p.Config.exitPolicy = policy
 
-	c, err := ssh.New(connInfo)
+	p.Config.sshConfig, err = loadSSHConfig(p.Config.sshConfigSetting)
 	if err != nil {
-		return errors.New(fmt.Sprintf("error creating ssh communicator: %s", err))
+		return err
 	}
 
-	var cmd ssh.Cmd
-	stdout := new(bytes.Buffer)
-	var b strings.Builder
-	cmd_string := fmt.Sprintf("echo %s | sudo -S chef-client", conf.sudopwd)
-	b.WriteString(cmd_string)
-	if len(conf.runList) > 0 {
-		b.WriteString(" -r ")
-		b.WriteString(strings.Join(conf.runList, ","))
+	targets, err := p.targets()
+	if err != nil {
+		return err
+	}
+
+	// interleaved output from several hosts is unreadable without a prefix
+	if len(targets) > 1 {
+		p.Config.outputPrefix = true
 	}
-	cmd.Command = b.String()
-	cmd.Stdout = stdout
 
-	err = c.Start(&cmd)
+	canaries, fleet, err := p.Config.splitCanaries(targets)
 	if err != nil {
-		return errors.New(fmt.Sprintf("error executing remote command: %s", err))
+		return err
+	}
+
+	results, err := p.canary(ctx, canaries)
+	if err != nil {
+		results = append(results, skipped(fleet)...)
+	} else {
+		var fleetResults []hostResult
+		fleetResults, err = p.rollout(ctx, fleet)
+		results = append(results, fleetResults...)
+	}
+
+	if reportErr := p.report(results); reportErr != nil {
+		return reportErr
+	}
+	if ctx.Err() != nil {
+		return errors.New("build cancelled")
+	}
+	if err != nil {
+		return err
+	}
+
+	if n := failures(results); n > 0 {
+		return fmt.Errorf("chef-client failed on %d of %d hosts", n, len(results))
+	}
+
+	return nil
+}
+
+// report prints the outcome of the run and writes any requested reports.
+func (p Plugin) report(results []hostResult) error {
+	printSummary(os.Stdout, results)
+	if lock := p.Config.policy; lock != nil {
+		fmt.Printf("policy %s revision %s\n", lock.Name, lock.RevisionID)
+	}
+
+	if !p.Config.whyRun {
+		return nil
+	}
+
+	printWhyRunSummary(os.Stdout, results)
+	if p.Config.whyRunReport != "" {
+		if err := writeWhyRunReport(p.Config.whyRunReport, results); err != nil {
+			return fmt.Errorf("error writing why-run report: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// targets returns the hosts to converge, falling back to the single host
+// setting when no hosts list is given.
+func (p Plugin) targets() ([]Target, error) {
+	targets, err := parseTargets(p.Config.hosts)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) > 0 {
+		return targets, nil
+	}
+
+	if p.Config.Host == "" {
+		return nil, errors.New("no host configured")
+	}
+	return []Target{{Host: p.Config.Host}}, nil
+}
+
+// runHost converges a single target, recording details of the run in res.
+func (p Plugin) runHost(ctx context.Context, t Target, res *hostResult) error {
+	r, err := p.dial(ctx, t)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	switch {
+	case r.conf.writeClientRB && r.conf.whyRun:
+		// a preview must not change the node, so chef-client reads the
+		// rendered client.rb from a temp file instead
+		tmp, err := r.uploadClientRB()
+		if err != nil {
+			return err
+		}
+		defer r.cleanup("rm -f "+ssh.ShellQuote(tmp), false)
+		r.conf.clientRBPath = tmp
+	case r.conf.writeClientRB:
+		if err := r.installClientRB(); err != nil {
+			return err
+		}
+	}
+
+	// inline attributes are uploaded to a private temp file for -j
+	attributes := r.conf.jsonAttributes
+	if isInlineJSON(attributes) {
+		attributes = remoteTempPath("drone-chef-attributes", ".json")
+		if err := r.writeFile(attributes, []byte(r.conf.jsonAttributes)); err != nil {
+			return fmt.Errorf("error uploading json attributes: %s", err)
+		}
+		defer r.cleanup("rm -f "+ssh.ShellQuote(attributes), false)
+	}
+
+	// local mode converges from cookbooks uploaded to a temp repo, which
+	// chef-client fills with root-owned files
+	if r.conf.localMode {
+		repo, err := r.uploadLocalRepo()
+		if err != nil {
+			return err
+		}
+		defer r.cleanup("rm -rf "+ssh.ShellQuote(repo), true)
+		r.repo = repo
 	}
 
+	return r.chefRun(attributes, res)
+}
+
+// chefRun runs chef-client and applies the exit code policy to the result,
+// rebooting and re-running it when the policy asks for it.
+func (r *remote) chefRun(attributes string, res *hostResult) error {
+	var transcript bytes.Buffer
+	if r.conf.whyRun {
+		r.capture = &transcript
+	}
+	command := r.conf.chefCommand(attributes)
+	if r.repo != "" {
+		command = inDir(r.repo, command)
+	}
+	err := r.sudoStoppable(command)
+	r.capture = nil
+
+	if r.conf.whyRun {
+		res.Pending = parseWhyRun(transcript.Bytes())
+	}
+
+	res.State = classifyRun(err)
+	if !res.State.hasExitCode() {
+		return err
+	}
+	switch r.conf.exitPolicy[res.State] {
+	case ActionSuccess:
+		if res.State != StateSuccess {
+			log.Printf("%s: chef-client finished with %s, treating it as success", r.connInfo.Host, res.State)
+		}
+		return nil
+	case ActionReboot:
+		// a why-run previews the converge and must not change the node
+		if r.conf.whyRun {
+			log.Printf("%s: chef-client finished with %s, not rebooting in why-run mode", r.connInfo.Host, res.State)
+			return nil
+		}
+		log.Printf("%s: chef-client finished with %s", r.connInfo.Host, res.State)
+		if err := r.rebootAndWait(res.State); err != nil {
+			return err
+		}
+		res.Reboots++
+
+		if !r.conf.rebootRerun {
+			return nil
+		}
+		if res.Reboots > maxRebootReruns {
+			return fmt.Errorf("chef-client still requests a reboot after %d reboots", res.Reboots)
+		}
+		log.Printf("%s: running chef-client again after reboot", r.connInfo.Host)
+		return r.chefRun(attributes, res)
+	}
+
+	if res.State != StateFailed {
+		return fmt.Errorf("chef-client finished with %s: %s", res.State, err)
+	}
 	return err
-}
\ No newline at end of file
+}
+
+// remote is an open connection to a single target, together with the
+// writers its command output is streamed to. Commands are stopped when ctx
+// is done.
+type remote struct {
+	ctx      context.Context
+	conf     Config
+	connInfo *ssh.ConnectionInfo
+	comm     ssh.Communicator
+
+	stdout *lineWriter
+	stderr *lineWriter
+
+	// capture, if set, receives a copy of all command output
+	capture io.Writer
+
+	// repo is the local mode chef repo on the target, if any
+	repo string
+}
+
+// dial connects to the target using the plugin config.
+func (p Plugin) dial(ctx context.Context, t Target) (*remote, error) {
+	conf, err := p.Config.withTarget(t).withSSHConfig(t.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	connInfo, err := parseConnectionInfo(&conf)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := ssh.New(connInfo)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("error creating ssh communicator: %s", err))
+	}
+
+	if err := c.Connect(ctx); err != nil {
+		return nil, errors.New(fmt.Sprintf("error connecting to %s: %s", connInfo.Host, err))
+	}
+
+	prefix := ""
+	if conf.outputPrefix {
+		prefix = connInfo.Host
+	}
+
+	return &remote{
+		ctx:      ctx,
+		conf:     conf,
+		connInfo: connInfo,
+		comm:     c,
+		stdout:   newLineWriter(os.Stdout, prefix, conf.outputTimestamps),
+		stderr:   newLineWriter(os.Stderr, prefix, conf.outputTimestamps),
+	}, nil
+}
+
+// withContext returns a copy of r whose commands are bound by ctx instead.
+func (r *remote) withContext(ctx context.Context) *remote {
+	c := *r
+	c.ctx = ctx
+	return &c
+}
+
+// Close flushes pending output and disconnects.
+func (r *remote) Close() error {
+	r.stdout.Close()
+	r.stderr.Close()
+	return r.comm.Disconnect()
+}
+
+// run executes a command on the target, streaming its output, and waits
+// for it to exit. stdin may be nil.
+func (r *remote) run(command string, stdin io.Reader) error {
+	return r.exec(&ssh.Cmd{
+		Command: command,
+		Stdin:   stdin,
+	})
+}
+
+// output runs a command on the target and returns its trimmed stdout
+// instead of streaming it. Being a quick probe, it only gets as long as a
+// connection attempt.
+func (r *remote) output(command string) (string, error) {
+	var stdout bytes.Buffer
+	cmd := &ssh.Cmd{
+		Command: command,
+		Stdout:  &stdout,
+		Stderr:  r.stderr,
+		NoPty:   true,
+		Timeout: r.comm.Timeout(),
+	}
+
+	if err := r.comm.Start(r.ctx, cmd); err != nil {
+		return "", err
+	}
+	if err := cmd.Wait(); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// writeFile writes content to a file on the target readable only by the
+// login user.
+func (r *remote) writeFile(path string, content []byte) error {
+	return r.comm.Upload(r.ctx, path, bytes.NewReader(content), 0600)
+}
+
+// exec starts cmd with its output streamed to the build log and waits for
+// it to exit. The command is stopped when it runs past the run timeout.
+func (r *remote) exec(cmd *ssh.Cmd) error {
+	cmd.Stdout = r.stdout
+	cmd.Stderr = r.stderr
+	if r.capture != nil {
+		capture := &syncWriter{w: r.capture}
+		cmd.Stdout = io.MultiWriter(r.stdout, capture)
+		cmd.Stderr = io.MultiWriter(r.stderr, capture)
+	}
+
+	if err := r.comm.Start(r.ctx, cmd); err != nil {
+		return errors.New(fmt.Sprintf("error executing remote command: %s", err))
+	}
+
+	return cmd.Wait()
+}
+
+// sudo runs a command as root. A configured sudo password is written to the
+// session's stdin so it never appears on the remote command line or in logs.
+// Without a password sudo runs non-interactively, and a root login needs no
+// sudo at all.
+func (r *remote) sudo(command string) error {
+	return r.exec(r.sudoCmd(command))
+}
+
+func (r *remote) sudoCmd(command string) *ssh.Cmd {
+	switch {
+	case r.connInfo.User == "root":
+		return &ssh.Cmd{Command: command}
+	case r.conf.sudopwd == "":
+		return &ssh.Cmd{Command: "sudo -n " + command}
+	}
+
+	return &ssh.Cmd{
+		Command: fmt.Sprintf("sudo -S -p %s %s", ssh.ShellQuote(sudoPrompt), command),
+		Stdin:   strings.NewReader(r.conf.sudopwd + "\n"),
+	}
+}
+
+// sudoStoppable runs a command as root like sudo, in a way that it can be
+// stopped when the build is cancelled or the run times out. sshd sends
+// signals as the login user, who may not signal a process running as root,
+// so the command records its PID and is signalled with sudo kill instead.
+func (r *remote) sudoStoppable(command string) error {
+	if r.connInfo.User == "root" {
+		return r.run(command, nil)
+	}
+
+	// noclobber refuses a file planted at the path beforehand
+	pidFile := remoteTempPath("drone-chef-client", ".pid")
+	script := fmt.Sprintf("set -C && echo $$ > %s && exec %s", ssh.ShellQuote(pidFile), command)
+	defer r.cleanup("rm -f "+ssh.ShellQuote(pidFile), true)
+
+	cmd := r.sudoCmd("sh -c " + ssh.ShellQuote(script))
+	cmd.Kill = func(signal string) error {
+		return r.kill(pidFile, signal)
+	}
+	return r.exec(cmd)
+}
+
+// kill sends signal to the root process whose PID is in pidFile. It has a
+// context of its own, since the run's context is done by the time a command
+// has to be stopped.
+func (r *remote) kill(pidFile, signal string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.comm.Timeout())
+	defer cancel()
+
+	k := r.withContext(ctx)
+	k.capture = nil
+
+	script := fmt.Sprintf("kill -%s \"$(cat %s)\"", signal, ssh.ShellQuote(pidFile))
+	return k.sudo("sh -c " + ssh.ShellQuote(script))
+}
+
+// cleanup runs a command removing what the run left on the target, as root
+// if asked. It has a context of its own so that it still runs, and is waited
+// for, once the build is cancelled.
+func (r *remote) cleanup(command string, root bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	c := r.withContext(ctx)
+
+	var err error
+	if root {
+		err = c.sudo(command)
+	} else {
+		err = c.run(command, nil)
+	}
+	if err != nil {
+		log.Printf("[WARN] %s: cleanup failed: %s", r.connInfo.Host, err)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	ssh "github.com/zywillc/drone-chef-client/ssh"
+)
+
+func TestParseConnectionInfoJumpHostKnownHosts(t *testing.T) {
+	cases := []struct {
+		name       string
+		jumpHosts  string
+		knownHosts []string
+	}{
+		{
+			name:       "shorthand",
+			jumpHosts:  "ops@bastion:2222,inner",
+			knownHosts: []string{"/etc/ssh/known_hosts", "/etc/ssh/known_hosts"},
+		},
+		{
+			name:       "json",
+			jumpHosts:  `[{"host": "bastion", "known_hosts": "/etc/ssh/bastion_known_hosts"}, {"host": "inner"}]`,
+			knownHosts: []string{"/etc/ssh/bastion_known_hosts", "/etc/ssh/known_hosts"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := &Config{Host: "web1", Known_Hosts: "/etc/ssh/known_hosts", jumpHosts: c.jumpHosts}
+			connInfo, err := parseConnectionInfo(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(connInfo.JumpHosts) != len(c.knownHosts) {
+				t.Fatalf("%d jump hosts, want %d", len(connInfo.JumpHosts), len(c.knownHosts))
+			}
+			for i, j := range connInfo.JumpHosts {
+				if j.KnownHosts != c.knownHosts[i] {
+					t.Errorf("jump host %d known_hosts = %q, want %q", i+1, j.KnownHosts, c.knownHosts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseConnectionInfoBastionKnownHosts(t *testing.T) {
+	cases := []struct {
+		name       string
+		bastion    string
+		knownHosts string
+	}{
+		{name: "inherited", knownHosts: "/etc/ssh/known_hosts"},
+		{name: "own", bastion: "/etc/ssh/bastion_known_hosts", knownHosts: "/etc/ssh/bastion_known_hosts"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := &Config{
+				Host:                "web1",
+				Known_Hosts:         "/etc/ssh/known_hosts",
+				Bastion_Host:        "bastion",
+				Bastion_Known_Hosts: c.bastion,
+			}
+			connInfo, err := parseConnectionInfo(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if connInfo.BastionKnownHosts != c.knownHosts {
+				t.Errorf("bastion known_hosts = %q, want %q", connInfo.BastionKnownHosts, c.knownHosts)
+			}
+		})
+	}
+}
+
+// fakeComm is a Communicator recording the commands it is asked to run,
+// along with their stdin. Every command exits 0.
+type fakeComm struct {
+	commands []string
+	stdin    []string
+
+	// started, if set, is called with every command once it is recorded
+	started func(*ssh.Cmd)
+}
+
+func (f *fakeComm) Connect(context.Context) error { return nil }
+func (f *fakeComm) Disconnect() error             { return nil }
+func (f *fakeComm) Timeout() time.Duration        { return time.Minute }
+func (f *fakeComm) RunTimeout() time.Duration     { return time.Hour }
+
+func (f *fakeComm) Start(ctx context.Context, cmd *ssh.Cmd) error {
+	cmd.Init()
+	f.commands = append(f.commands, cmd.Command)
+
+	var stdin string
+	if cmd.Stdin != nil {
+		b, err := ioutil.ReadAll(cmd.Stdin)
+		if err != nil {
+			return err
+		}
+		stdin = string(b)
+	}
+	f.stdin = append(f.stdin, stdin)
+
+	if f.started != nil {
+		f.started(cmd)
+	}
+	cmd.SetExitStatus(0, nil)
+	return nil
+}
+
+func (f *fakeComm) Upload(context.Context, string, io.Reader, os.FileMode) error { return nil }
+func (f *fakeComm) UploadDir(context.Context, string, string) error              { return nil }
+func (f *fakeComm) Download(context.Context, string, io.Writer) error            { return nil }
+
+func TestRemoteSudo(t *testing.T) {
+	cases := []struct {
+		name     string
+		user     string
+		password string
+		command  string
+		stdin    string
+	}{
+		{
+			name:    "root",
+			user:    "root",
+			command: "chef-client -z",
+		},
+		{
+			name:     "root with a password",
+			user:     "root",
+			password: "s3cret",
+			command:  "chef-client -z",
+		},
+		{
+			name:    "no password",
+			user:    "centos",
+			command: "sudo -n chef-client -z",
+		},
+		{
+			name:     "password",
+			user:     "centos",
+			password: "s3cret",
+			command:  "sudo -S -p '[sudo] chef-client password: ' chef-client -z",
+			stdin:    "s3cret\n",
+		},
+		{
+			name:     "password with shell syntax",
+			user:     "centos",
+			password: "it's $(reboot)",
+			command:  "sudo -S -p '[sudo] chef-client password: ' chef-client -z",
+			stdin:    "it's $(reboot)\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			comm := &fakeComm{}
+			r := &remote{
+				ctx:      context.Background(),
+				conf:     Config{sudopwd: c.password},
+				connInfo: &ssh.ConnectionInfo{Host: "web1", User: c.user},
+				comm:     comm,
+				stdout:   newLineWriter(ioutil.Discard, "", false),
+				stderr:   newLineWriter(ioutil.Discard, "", false),
+			}
+
+			if err := r.sudo("chef-client -z"); err != nil {
+				t.Fatal(err)
+			}
+			if len(comm.commands) != 1 {
+				t.Fatalf("ran %d commands, want 1", len(comm.commands))
+			}
+			if comm.commands[0] != c.command {
+				t.Errorf("command = %q, want %q", comm.commands[0], c.command)
+			}
+			if comm.stdin[0] != c.stdin {
+				t.Errorf("stdin = %q, want %q", comm.stdin[0], c.stdin)
+			}
+			if c.password != "" && strings.Contains(comm.commands[0], c.password) {
+				t.Errorf("password on the command line: %q", comm.commands[0])
+			}
+		})
+	}
+}
+
+func TestRemoteSudoStoppable(t *testing.T) {
+	pidFileRe := regexp.MustCompile(`/var/tmp/drone-chef-client-[0-9a-f]{16}\.pid`)
+
+	cases := []struct {
+		name     string
+		user     string
+		password string
+
+		// commands are expected in order, with PIDFILE standing for the
+		// random PID file path
+		commands []string
+		stdin    []string
+	}{
+		{
+			name:     "root",
+			user:     "root",
+			commands: []string{"chef-client -z"},
+			stdin:    []string{""},
+		},
+		{
+			name: "no password",
+			user: "centos",
+			commands: []string{
+				`sudo -n sh -c 'set -C && echo $$ > '\''PIDFILE'\'' && exec chef-client -z'`,
+				`sudo -n sh -c 'kill -TERM "$(cat '\''PIDFILE'\'')"'`,
+				`sudo -n rm -f 'PIDFILE'`,
+			},
+			stdin: []string{"", "", ""},
+		},
+		{
+			name:     "password",
+			user:     "centos",
+			password: "s3cret",
+			commands: []string{
+				`sudo -S -p '[sudo] chef-client password: ' sh -c 'set -C && echo $$ > '\''PIDFILE'\'' && exec chef-client -z'`,
+				`sudo -S -p '[sudo] chef-client password: ' sh -c 'kill -TERM "$(cat '\''PIDFILE'\'')"'`,
+				`sudo -S -p '[sudo] chef-client password: ' rm -f 'PIDFILE'`,
+			},
+			stdin: []string{"s3cret\n", "s3cret\n", "s3cret\n"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			comm := &fakeComm{}
+			comm.started = func(cmd *ssh.Cmd) {
+				// stop the run as a cancelled build would
+				if len(comm.commands) == 1 {
+					if (cmd.Kill != nil) != (c.user != "root") {
+						t.Errorf("kill set: %t, want %t", cmd.Kill != nil, c.user != "root")
+					}
+					if cmd.Kill != nil {
+						if err := cmd.Kill("TERM"); err != nil {
+							t.Errorf("kill: %s", err)
+						}
+					}
+				}
+			}
+			r := &remote{
+				ctx:      context.Background(),
+				conf:     Config{sudopwd: c.password},
+				connInfo: &ssh.ConnectionInfo{Host: "web1", User: c.user},
+				comm:     comm,
+				stdout:   newLineWriter(ioutil.Discard, "", false),
+				stderr:   newLineWriter(ioutil.Discard, "", false),
+			}
+
+			if err := r.sudoStoppable("chef-client -z"); err != nil {
+				t.Fatal(err)
+			}
+
+			pidFile := pidFileRe.FindString(comm.commands[0])
+			var commands []string
+			for _, command := range comm.commands {
+				if pidFile != "" {
+					command = strings.Replace(command, pidFile, "PIDFILE", -1)
+				}
+				commands = append(commands, command)
+			}
+			if !reflect.DeepEqual(commands, c.commands) {
+				t.Errorf("commands =\n%s\nwant\n%s", strings.Join(commands, "\n"), strings.Join(c.commands, "\n"))
+			}
+			if !reflect.DeepEqual(comm.stdin, c.stdin) {
+				t.Errorf("stdin = %q, want %q", comm.stdin, c.stdin)
+			}
+		})
+	}
+}
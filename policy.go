@@ -0,0 +1,107 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	ssh "github.com/zywillc/drone-chef-client/ssh"
+)
+
+// policyLockFile is the lock file at the top of a policy export
+const policyLockFile = "Policyfile.lock.json"
+
+// policyLock holds the parts of a Policyfile lock the plugin reports.
+type policyLock struct {
+	Name       string `json:"name"`
+	RevisionID string `json:"revision_id"`
+}
+
+// readPolicyArchive returns the lock of the policy in a tarball created by
+// `chef export --archive`.
+func readPolicyArchive(name string) (*policyLock, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy archive: %s", err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy archive %s: %s", name, err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("invalid policy archive %s: no %s", name, policyLockFile)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy archive %s: %s", name, err)
+		}
+		if path.Clean(strings.TrimPrefix(hdr.Name, "./")) != policyLockFile {
+			continue
+		}
+
+		lock := &policyLock{}
+		if err := json.NewDecoder(tr).Decode(lock); err != nil {
+			return nil, fmt.Errorf("invalid %s in %s: %s", policyLockFile, name, err)
+		}
+		if lock.Name == "" || lock.RevisionID == "" {
+			return nil, fmt.Errorf("invalid %s in %s: missing name or revision_id", policyLockFile, name)
+		}
+		return lock, nil
+	}
+}
+
+// loadPolicyArchive reads the configured policy archive, if any. An archive
+// is always converged in local mode, from the policy group it was exported
+// with.
+func (c *Config) loadPolicyArchive() error {
+	if c.policyArchive == "" {
+		return nil
+	}
+
+	lock, err := readPolicyArchive(c.policyArchive)
+	if err != nil {
+		return err
+	}
+	if c.policyName != "" && c.policyName != lock.Name {
+		return fmt.Errorf("policy archive %s holds policy %q, not %q", c.policyArchive, lock.Name, c.policyName)
+	}
+
+	log.Printf("converging policy %s revision %s", lock.Name, lock.RevisionID)
+	c.policy = lock
+	c.localMode = true
+	return nil
+}
+
+// uploadPolicyArchive uploads the policy archive to the target and unpacks
+// it into repo.
+func (r *remote) uploadPolicyArchive(repo string) error {
+	f, err := os.Open(r.conf.policyArchive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	archive := path.Join(repo, "policy.tgz")
+	log.Printf("%s: uploading %s to %s", r.connInfo.Host, r.conf.policyArchive, archive)
+	if err := r.comm.Upload(r.ctx, archive, f, 0600); err != nil {
+		return fmt.Errorf("error uploading policy archive: %s", err)
+	}
+
+	q := ssh.ShellQuote(archive)
+	if err := r.run(fmt.Sprintf("tar -xzf %s -C %s && rm -f %s", q, ssh.ShellQuote(repo), q), nil); err != nil {
+		return fmt.Errorf("error unpacking policy archive: %s", err)
+	}
+	return nil
+}
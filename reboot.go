@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// DefaultRebootTimeout is used if there is no reboot timeout given
+	DefaultRebootTimeout = 10 * time.Minute
+
+	// rebootPoll is the interval between checks while a node reboots
+	rebootPoll = 5 * time.Second
+
+	// rebootProbeTimeout bounds a single check whether a node went down.
+	// A check that cannot reconnect in time counts as the node being down.
+	rebootProbeTimeout = 30 * time.Second
+
+	// maxRebootReruns bounds how often chef-client is re-run after a reboot
+	maxRebootReruns = 3
+
+	bootIDCommand = "cat /proc/sys/kernel/random/boot_id"
+)
+
+// rebootAndWait reboots the target, unless chef-client has already started
+// a reboot, waits for the SSH connection to drop and then reconnects until
+// the node answers again or the reboot timeout runs out. The kernel boot id
+// tells a rebooted node apart from one that never went down.
+func (r *remote) rebootAndWait(state RunState) error {
+	host := r.connInfo.Host
+	deadline := time.Now().Add(r.conf.rebootTimeout)
+
+	// a session opened on a dropped connection reconnects, retrying for
+	// the whole connect timeout, so every check is bound by the deadline
+	ctx, cancel := context.WithDeadline(r.ctx, deadline)
+	defer cancel()
+
+	bootID, err := r.output(bootIDCommand)
+	if err != nil {
+		log.Printf("[WARN] %s: unable to read boot id: %s", host, err)
+	}
+
+	if state != StateRebootScheduled && state != StateRebootNow {
+		log.Printf("%s: rebooting with %q", host, r.conf.rebootCommand)
+		// the connection may drop underneath the command, so its error says
+		// nothing about whether the reboot was issued
+		r.withContext(ctx).sudo(r.conf.rebootCommand)
+	}
+
+	log.Printf("%s: waiting for the connection to drop", host)
+	for {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s did not go down within %s", host, r.conf.rebootTimeout)
+		}
+		if err := r.sleep(rebootPoll); err != nil {
+			return err
+		}
+
+		probe, cancelProbe := context.WithTimeout(ctx, rebootProbeTimeout)
+		id, err := r.withContext(probe).output(bootIDCommand)
+		cancelProbe()
+		if err != nil {
+			break
+		}
+		if bootID != "" && id != bootID {
+			// rebooted and back before we noticed it was gone
+			log.Printf("%s: back after reboot", host)
+			return nil
+		}
+	}
+
+	log.Printf("%s: down, waiting for it to come back", host)
+	for {
+		err := r.comm.Connect(ctx)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s did not come back within %s of the reboot: %s", host, r.conf.rebootTimeout, err)
+		}
+		if err := r.sleep(rebootPoll); err != nil {
+			return err
+		}
+	}
+
+	if bootID != "" {
+		id, err := r.output(bootIDCommand)
+		if err != nil {
+			return fmt.Errorf("error checking boot id on %s after reboot: %s", host, err)
+		}
+		if id == bootID {
+			return fmt.Errorf("%s came back without rebooting", host)
+		}
+	}
+
+	log.Printf("%s: back after reboot", host)
+	return nil
+}
+
+// sleep waits for d, returning early with an error if the build is
+// cancelled.
+func (r *remote) sleep(d time.Duration) error {
+	select {
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	ssh "github.com/zywillc/drone-chef-client/ssh"
+)
+
+// batchSize resolves the batch-size setting, either an absolute number of
+// hosts or a percentage of total, into a number of hosts per batch. An empty
+// setting puts every host in a single batch.
+func batchSize(setting string, total int) (int, error) {
+	setting = strings.TrimSpace(setting)
+	if setting == "" {
+		return total, nil
+	}
+
+	if strings.HasSuffix(setting, "%") {
+		pct, err := strconv.Atoi(strings.TrimSuffix(setting, "%"))
+		if err != nil || pct <= 0 || pct > 100 {
+			return 0, fmt.Errorf("invalid batch size %q: expected a percentage between 1%% and 100%%", setting)
+		}
+		// round up so that a small fleet still makes progress
+		n := (total*pct + 99) / 100
+		if n < 1 {
+			n = 1
+		}
+		return n, nil
+	}
+
+	n, err := strconv.Atoi(setting)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid batch size %q: expected a positive number or a percentage", setting)
+	}
+	if n > total {
+		n = total
+	}
+	return n, nil
+}
+
+// toleranceExceeded reports whether failed hosts out of total exceed the
+// configured failure tolerance. With no tolerance configured any failure
+// stops the rollout.
+func (c Config) toleranceExceeded(failed, total int) bool {
+	if failed == 0 {
+		return false
+	}
+	if c.maxFailures == 0 && c.maxFailurePercentage == 0 {
+		return true
+	}
+	if c.maxFailures > 0 && failed > c.maxFailures {
+		return true
+	}
+	if c.maxFailurePercentage > 0 && failed*100 > c.maxFailurePercentage*total {
+		return true
+	}
+	return false
+}
+
+// rollout converges the targets batch by batch. Once the failure tolerance
+// is exceeded, or ctx is cancelled, the remaining batches are skipped.
+func (p Plugin) rollout(ctx context.Context, targets []Target) ([]hostResult, error) {
+	size, err := batchSize(p.Config.batchSize, len(targets))
+	if err != nil {
+		return nil, err
+	}
+
+	var results []hostResult
+	for start := 0; start < len(targets); start += size {
+		end := start + size
+		if end > len(targets) {
+			end = len(targets)
+		}
+
+		if start > 0 && p.Config.batchPause > 0 {
+			log.Printf("pausing %s before the next batch", p.Config.batchPause)
+			select {
+			case <-ctx.Done():
+			case <-time.After(p.Config.batchPause):
+			}
+		}
+		if ctx.Err() != nil {
+			results = append(results, skipped(targets[start:])...)
+			return results, ctx.Err()
+		}
+
+		batch := start/size + 1
+		if size < len(targets) {
+			log.Printf("converging batch %d: hosts %d-%d of %d", batch, start+1, end, len(targets))
+		}
+		results = append(results, p.converge(ctx, targets[start:end])...)
+
+		failed := failures(results)
+		if end < len(targets) && p.Config.toleranceExceeded(failed, len(targets)) {
+			results = append(results, skipped(targets[end:])...)
+			return results, fmt.Errorf("rollout aborted after batch %d: %d of %d hosts failed", batch, failed, len(targets))
+		}
+	}
+
+	return results, nil
+}
+
+// splitCanaries separates the canary targets from the rest of the fleet.
+// Canaries are the hosts named in canary-hosts or, failing that, the first
+// canary-count targets.
+func (c Config) splitCanaries(targets []Target) ([]Target, []Target, error) {
+	if len(c.canaryHosts) == 0 {
+		n := c.canaryCount
+		if n > len(targets) {
+			n = len(targets)
+		}
+		if n < 0 {
+			n = 0
+		}
+		return targets[:n], targets[n:], nil
+	}
+
+	named := make([]Target, len(c.canaryHosts))
+	for i, h := range c.canaryHosts {
+		user, host, port, err := ssh.ParseAddress(h)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid canary host: %s", err)
+		}
+		named[i] = Target{Host: host, User: user, Port: port}
+	}
+
+	matched := make([]bool, len(named))
+	var canaries, rest []Target
+	for _, t := range targets {
+		canary := false
+		for i, n := range named {
+			if c.namesTarget(n, t) {
+				matched[i] = true
+				canary = true
+			}
+		}
+		if canary {
+			canaries = append(canaries, t)
+		} else {
+			rest = append(rest, t)
+		}
+	}
+
+	for i, ok := range matched {
+		if !ok {
+			return nil, nil, fmt.Errorf("canary host %q is not in the hosts list", c.canaryHosts[i])
+		}
+	}
+
+	return canaries, rest, nil
+}
+
+// namesTarget reports whether the canary-hosts entry n names the target t.
+// Hosts are compared after the ssh config resolves aliases, so either side
+// may use the alias or its HostName. A user or port is only compared when n
+// gives one, against what the target connects with.
+func (c Config) namesTarget(n, t Target) bool {
+	if c.resolveHost(n.Host) != c.resolveHost(t.Host) {
+		return false
+	}
+	if n.User != "" && n.User != firstNonEmpty(t.User, c.User, DefaultUser) {
+		return false
+	}
+	if n.Port != 0 && n.Port != firstNonZero(t.Port, c.Port, DefaultPort) {
+		return false
+	}
+	return true
+}
+
+// resolveHost returns the HostName the ssh config gives for alias, or alias
+// itself.
+func (c Config) resolveHost(alias string) string {
+	if c.sshConfig == nil {
+		return alias
+	}
+	h, err := lookupSSHHost(c.sshConfig, alias)
+	if err != nil || h.HostName == "" {
+		return alias
+	}
+	return h.HostName
+}
+
+// canary converges the canary hosts and then runs the verification command
+// on each of them. The fleet may only proceed when no error is returned,
+// which needs every canary's chef-client to exit 0 whatever the exit code
+// policy.
+func (p Plugin) canary(ctx context.Context, canaries []Target) ([]hostResult, error) {
+	if len(canaries) == 0 {
+		return nil, nil
+	}
+
+	log.Printf("converging %d canary hosts", len(canaries))
+	results := p.converge(ctx, canaries)
+
+	requireSuccess(results)
+	if n := failures(results); n > 0 {
+		return results, fmt.Errorf("canary stage failed on %d of %d hosts", n, len(canaries))
+	}
+
+	if p.Config.canaryVerify == "" {
+		return results, nil
+	}
+
+	for i, t := range canaries {
+		if err := p.verify(ctx, t); err != nil {
+			results[i].Err = fmt.Errorf("canary verification failed: %s", err)
+		}
+	}
+	if n := failures(results); n > 0 {
+		return results, fmt.Errorf("canary verification failed on %d of %d hosts", n, len(canaries))
+	}
+
+	return results, nil
+}
+
+// requireSuccess fails the results of canaries whose chef-client did not
+// exit 0, since the exit code policy may have accepted other states.
+func requireSuccess(results []hostResult) {
+	for i := range results {
+		if results[i].Err == nil && results[i].State != StateSuccess {
+			results[i].Err = fmt.Errorf("canary chef-client finished with %s", results[i].State)
+		}
+	}
+}
+
+// verify runs the canary verification command on the target.
+func (p Plugin) verify(ctx context.Context, t Target) error {
+	r, err := p.dial(ctx, t)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return r.run(p.Config.canaryVerify, nil)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func firstNonZero(values ...int) int {
+	for _, v := range values {
+		if v != 0 {
+			return v
+		}
+	}
+	return 0
+}
+
+// skipped returns a skipped result for every target.
+func skipped(targets []Target) []hostResult {
+	results := make([]hostResult, 0, len(targets))
+	for _, t := range targets {
+		results = append(results, hostResult{Host: t.Host, Skipped: true})
+	}
+	return results
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBatchSize(t *testing.T) {
+	cases := []struct {
+		setting string
+		total   int
+		size    int
+		err     bool
+	}{
+		{"", 7, 7, false},
+		{" 2 ", 7, 2, false},
+		{"10", 7, 7, false},
+		{"25%", 8, 2, false},
+		{"25%", 7, 2, false},
+		{"1%", 3, 1, false},
+		{"100%", 7, 7, false},
+		{"0", 7, 0, true},
+		{"-1", 7, 0, true},
+		{"0%", 7, 0, true},
+		{"101%", 7, 0, true},
+		{"half", 7, 0, true},
+		{"x%", 7, 0, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.setting, func(t *testing.T) {
+			size, err := batchSize(c.setting, c.total)
+			if (err != nil) != c.err {
+				t.Fatalf("error = %v, want error: %t", err, c.err)
+			}
+			if size != c.size {
+				t.Errorf("batchSize(%q, %d) = %d, want %d", c.setting, c.total, size, c.size)
+			}
+		})
+	}
+}
+
+func TestToleranceExceeded(t *testing.T) {
+	cases := []struct {
+		name        string
+		maxFailures int
+		maxPercent  int
+		failed      int
+		total       int
+		exceeded    bool
+	}{
+		{"no failures", 0, 0, 0, 10, false},
+		{"no tolerance", 0, 0, 1, 10, true},
+		{"within count", 2, 0, 2, 10, false},
+		{"over count", 2, 0, 3, 10, true},
+		{"within percentage", 0, 20, 2, 10, false},
+		{"over percentage", 0, 20, 3, 10, true},
+		{"over count within percentage", 1, 50, 2, 10, true},
+		{"within count over percentage", 5, 10, 2, 10, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := Config{maxFailures: c.maxFailures, maxFailurePercentage: c.maxPercent}
+			if exceeded := conf.toleranceExceeded(c.failed, c.total); exceeded != c.exceeded {
+				t.Errorf("toleranceExceeded(%d, %d) = %t, want %t", c.failed, c.total, exceeded, c.exceeded)
+			}
+		})
+	}
+}
+
+func TestSplitCanaries(t *testing.T) {
+	cfg, err := loadSSHConfig("Host web2\n  HostName web2.example.com\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := []Target{
+		{Host: "web1"},
+		{Host: "web2"},
+		{Host: "web3", User: "deploy", Port: 2222},
+		{Host: "web4"},
+	}
+
+	cases := []struct {
+		name     string
+		conf     Config
+		canaries []string
+		err      bool
+	}{
+		{name: "none"},
+		{name: "count", conf: Config{canaryCount: 2}, canaries: []string{"web1", "web2"}},
+		{name: "count past the fleet", conf: Config{canaryCount: 9}, canaries: []string{"web1", "web2", "web3", "web4"}},
+		{name: "negative count", conf: Config{canaryCount: -1}},
+		{name: "host", conf: Config{canaryHosts: []string{"web4", "web1"}}, canaries: []string{"web1", "web4"}},
+		{name: "host overrides count", conf: Config{canaryHosts: []string{"web4"}, canaryCount: 2}, canaries: []string{"web4"}},
+		{name: "user and port", conf: Config{canaryHosts: []string{"deploy@web3:2222"}}, canaries: []string{"web3"}},
+		{name: "default user", conf: Config{canaryHosts: []string{"centos@web1"}}, canaries: []string{"web1"}},
+		{name: "plugin user", conf: Config{User: "ops", canaryHosts: []string{"ops@web1:22"}}, canaries: []string{"web1"}},
+		{name: "plugin port", conf: Config{Port: 2200, canaryHosts: []string{"web1:2200"}}, canaries: []string{"web1"}},
+		{name: "hostname of an alias", conf: Config{sshConfig: cfg, canaryHosts: []string{"web2.example.com"}}, canaries: []string{"web2"}},
+		{name: "alias without ssh config", conf: Config{canaryHosts: []string{"web2.example.com"}}, err: true},
+		{name: "other user", conf: Config{canaryHosts: []string{"root@web3"}}, err: true},
+		{name: "other port", conf: Config{canaryHosts: []string{"web1:2222"}}, err: true},
+		{name: "unknown host", conf: Config{canaryHosts: []string{"web1", "db1"}}, err: true},
+		{name: "invalid entry", conf: Config{canaryHosts: []string{"web1:ssh"}}, err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			canaries, rest, err := c.conf.splitCanaries(targets)
+			if (err != nil) != c.err {
+				t.Fatalf("error = %v, want error: %t", err, c.err)
+			}
+			if c.err {
+				return
+			}
+
+			var hosts []string
+			for _, t := range canaries {
+				hosts = append(hosts, t.Host)
+			}
+			if !reflect.DeepEqual(hosts, c.canaries) {
+				t.Errorf("canaries = %v, want %v", hosts, c.canaries)
+			}
+			if len(canaries)+len(rest) != len(targets) {
+				t.Errorf("%d canaries and %d others, want %d targets", len(canaries), len(rest), len(targets))
+			}
+		})
+	}
+}
+
+func TestRequireSuccess(t *testing.T) {
+	failed := errors.New("chef-client exited 1")
+	results := []hostResult{
+		{Host: "web1", State: StateSuccess},
+		{Host: "web2", State: StateRebootScheduled},
+		{Host: "web3", State: StateFailed, Err: failed},
+		{Host: "web4", Skipped: true},
+	}
+
+	requireSuccess(results)
+
+	want := []string{"", "canary chef-client finished with reboot-scheduled", failed.Error(), ""}
+	for i, r := range results {
+		got := ""
+		if r.Err != nil {
+			got = r.Err.Error()
+		}
+		if got != want[i] {
+			t.Errorf("%s: error = %q, want %q", r.Host, got, want[i])
+		}
+	}
+}
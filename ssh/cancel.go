@@ -0,0 +1,83 @@
+package ssh
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// cancelGracePeriod is how long a cancelled command is given to exit after
+// each signal before stronger measures are taken
+const cancelGracePeriod = 10 * time.Second
+
+// interrupt stops the command running in session once ctx is done. The
+// remote process is sent SIGTERM and, if it is still running after the grace
+// period, SIGKILL, through kill if it is set or else as signal requests.
+// Servers that ignore signal requests get the session closed instead, which
+// hangs up a command running on a pty. A host that is gone never confirms
+// any of it, so the last resort is disconnect. done must be closed when the
+// session ends.
+func interrupt(ctx context.Context, session *ssh.Session, kill func(string) error, disconnect func() error, done <-chan struct{}, command string) {
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	signal := func(sig ssh.Signal) func() error {
+		if kill != nil {
+			return func() error { return kill(string(sig)) }
+		}
+		return func() error { return session.Signal(sig) }
+	}
+
+	steps := []struct {
+		name string
+		stop func() error
+	}{
+		{"SIGTERM", signal(ssh.SIGTERM)},
+		{"SIGKILL", signal(ssh.SIGKILL)},
+		{"hangup", session.Close},
+		{"disconnect", disconnect},
+	}
+
+	for _, step := range steps {
+		log.Printf("[WARN] %s, sending %s to: %s", ctx.Err(), step.name, command)
+		if err := step.stop(); err != nil {
+			log.Printf("[WARN] error sending %s: %s", step.name, err)
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(cancelGracePeriod):
+		}
+	}
+}
+
+// untilDone runs step, a channel open or request on the connection, and
+// closes the connection if ctx is done first. Those wait for the server's
+// reply, which a host that vanished without closing the connection never
+// sends, and closing the connection is the only way to stop them. The
+// connection is reopened by the next newSession.
+func (c *SSHCommunicator) untilDone(ctx context.Context, step func() error) error {
+	client := c.client
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			log.Printf("[WARN] %s, closing the connection to %s", ctx.Err(), c.connInfo.Host)
+			client.Close()
+		}
+	}()
+
+	err := step()
+	close(done)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
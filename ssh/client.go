@@ -1,11 +1,16 @@
 package ssh
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -16,8 +21,9 @@ import (
  SSHCommunicator
 **************/
 type Communicator interface {
-	// Connect is used to setup the connection
-	Connect() error
+	// Connect is used to setup the connection, giving up when the context
+	// is done
+	Connect(context.Context) error
 
 	// Disconnect is used to terminate the connection
 	Disconnect() error
@@ -25,8 +31,25 @@ type Communicator interface {
 	// Timeout returns the configured connection timeout
 	Timeout() time.Duration
 
-	// Start executes a remote command in a new session
-	Start(*Cmd) error
+	// RunTimeout returns the configured timeout for remote commands
+	RunTimeout() time.Duration
+
+	// Start executes a remote command in a new session. The command is
+	// signalled to stop when the context is done or its timeout expires.
+	Start(context.Context, *Cmd) error
+
+	// Upload writes the contents of the reader to a file on the remote
+	// host with the given mode, giving up when the context is done
+	Upload(context.Context, string, io.Reader, os.FileMode) error
+
+	// UploadDir copies the contents of a local directory (third argument)
+	// into a remote directory (second argument), giving up when the context
+	// is done
+	UploadDir(context.Context, string, string) error
+
+	// Download copies a remote file into the writer, giving up when the
+	// context is done
+	Download(context.Context, string, io.Writer) error
 }
 
 // SSHCommunicator represents the SSH SSHCommunicator
@@ -37,6 +60,10 @@ type SSHCommunicator struct {
 	config   *sshConfig
 	conn     net.Conn
 	address  string
+
+	// lost records why the keepalive gave up on the current connection
+	lostMu sync.Mutex
+	lost   error
 }
 
 // New creates a new SSHCommunicator implementation over SSH.
@@ -54,27 +81,78 @@ func New(connInfo *ConnectionInfo) (*SSHCommunicator, error) {
 	return comm, nil
 }
 
-func (c *SSHCommunicator) newSession() (session *ssh.Session, err error) {
+func (c *SSHCommunicator) newSession(ctx context.Context) (session *ssh.Session, err error) {
 	log.Println("[DEBUG] opening new ssh session")
 	if c.client == nil {
 		err = errors.New("ssh client is not connected")
 	} else {
-		session, err = c.client.NewSession()
+		session, err = c.openSession(ctx)
 	}
 
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		log.Printf("[WARN] ssh session open error: '%s', attempting reconnect", err)
-		if err := c.Connect(); err != nil {
+		if err := c.Connect(ctx); err != nil {
 			return nil, err
 		}
 
-		return c.client.NewSession()
+		return c.openSession(ctx)
 	}
 
 	return session, nil
 }
-// Connect implementation of Communicator.SSHCommunicator interface
-func (c *SSHCommunicator) Connect() (err error) {
+
+// openSession opens a session on the current connection, giving up when ctx
+// is done.
+func (c *SSHCommunicator) openSession(ctx context.Context) (session *ssh.Session, err error) {
+	err = c.untilDone(ctx, func() (err error) {
+		session, err = c.client.NewSession()
+		return err
+	})
+	return session, err
+}
+
+// Connect implementation of Communicator.SSHCommunicator interface.
+// Retryable failures are retried with jittered exponential backoff until
+// the connection timeout runs out or the context is done.
+func (c *SSHCommunicator) Connect(ctx context.Context) error {
+	deadline := time.Now().Add(c.connInfo.TimeoutVal)
+	backoff := initialBackoff
+
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := c.connect(ctx)
+		if err == nil {
+			return nil
+		}
+		if !retryable(err) {
+			return err
+		}
+
+		wait := jitter(backoff)
+		if time.Now().Add(wait).After(deadline) {
+			return fmt.Errorf("giving up after %d connection attempts: %s", attempt, err)
+		}
+		log.Printf("[WARN] connection attempt %d failed: %s, retrying in %s", attempt, err, wait)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// connect makes a single attempt at connecting and handshaking.
+func (c *SSHCommunicator) connect(ctx context.Context) (err error) {
 
 	if c.conn != nil {
 		c.conn.Close()
@@ -85,7 +163,7 @@ func (c *SSHCommunicator) Connect() (err error) {
 	c.client = nil
 
 
-	log.Printf(fmt.Sprintf(
+	log.Printf(
 		"[DEBUG] Connecting to remote host via SSH...\n"+
 			"  Host: %s\n"+
 			"  User: %s\n"+
@@ -97,11 +175,11 @@ func (c *SSHCommunicator) Connect() (err error) {
 		c.connInfo.Password != "",
 		c.connInfo.PrivateKey != "",
 		c.connInfo.Agent,
-		c.connInfo.HostKey != "",
-	))
+		c.connInfo.HostKey != "" || c.connInfo.KnownHosts != "",
+	)
 
-	if c.connInfo.BastionHost != "" {
-		log.Printf(fmt.Sprintf(
+	if c.connInfo.BastionHost != "" && len(c.connInfo.JumpHosts) == 0 {
+		log.Printf(
 			"[DEBUG] Using configured bastion host...\n"+
 				"  Host: %s\n"+
 				"  User: %s\n"+
@@ -113,28 +191,60 @@ func (c *SSHCommunicator) Connect() (err error) {
 			c.connInfo.BastionPassword != "",
 			c.connInfo.BastionPrivateKey != "",
 			c.connInfo.Agent,
-			c.connInfo.BastionHostKey != "",
-		))
+			c.connInfo.BastionHostKey != "" || c.connInfo.BastionKnownHosts != "",
+		)
 	}
 
-	log.Printf("[DEBUG] connecting to TCP connection for SSH")
-	c.conn, err = c.config.connection()
-	if err != nil {
-		c.conn = nil
-
-		log.Printf("[ERROR] connection error: %s", err)
-		return err
+	for i, j := range c.connInfo.JumpHosts {
+		log.Printf(
+			"[DEBUG] Using configured jump host %d...\n"+
+				"  Host: %s\n"+
+				"  User: %s\n"+
+				"  Password: %t\n"+
+				"  Private key: %t\n"+
+				"  SSH Agent: %t\n"+
+				"  Checking Host Key: %t",
+			i+1, j.Host, j.User,
+			j.Password != "",
+			j.PrivateKey != "",
+			c.connInfo.Agent,
+			j.HostKey != "" || j.KnownHosts != "",
+		)
 	}
 
-	log.Printf("[DEBUG] handshaking with SSH")
-	host := fmt.Sprintf("%s:%d", c.connInfo.Host, c.connInfo.Port)
-	sshConn, sshChan, req, err := ssh.NewClientConn(c.conn, host, c.config.config)
+	err = withHostKeyRetry(c.config.config, func(conf *ssh.ClientConfig) error {
+		log.Printf("[DEBUG] connecting to TCP connection for SSH")
+		conn, err := c.config.connection()
+		if err != nil {
+			log.Printf("[ERROR] connection error: %s", err)
+			return err
+		}
+
+		log.Printf("[DEBUG] handshaking with SSH")
+		host := net.JoinHostPort(c.connInfo.Host, strconv.Itoa(c.connInfo.Port))
+		// a server that accepts the connection but never answers must not
+		// hang the handshake
+		conn.SetDeadline(time.Now().Add(c.config.dialTimeout))
+		sshConn, sshChan, req, err := ssh.NewClientConn(conn, host, conf)
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			log.Printf("[WARN] %s", err)
+			conn.Close()
+			return err
+		}
+
+		c.conn = conn
+		c.client = ssh.NewClient(sshConn, sshChan, req)
+		return nil
+	})
 	if err != nil {
-		log.Printf("[WARN] %s", err)
 		return err
 	}
 
-	c.client = ssh.NewClient(sshConn, sshChan, req)
+	c.setLost(nil)
+	if c.connInfo.KeepAliveInterval > 0 {
+		go c.keepAlive(c.client, c.connInfo.KeepAliveInterval, c.connInfo.KeepAliveMaxMissed)
+	}
 
 	if c.config.sshAgent != nil {
 		log.Printf("[DEBUG] Telling SSH config to forward to agent")
@@ -143,7 +253,7 @@ func (c *SSHCommunicator) Connect() (err error) {
 		}
 
 		log.Printf("[DEBUG] Setting up a session to request agent forwarding")
-		session, err := c.newSession()
+		session, err := c.newSession(ctx)
 		if err != nil {
 			return err
 		}
@@ -184,13 +294,17 @@ func (c *SSHCommunicator) Timeout() time.Duration {
 	return c.connInfo.TimeoutVal
 }
 
+// RunTimeout implementation of Communicator.SSHCommunicator interface
+func (c *SSHCommunicator) RunTimeout() time.Duration {
+	return c.connInfo.RunTimeoutVal
+}
 
 // Start implementation of Communicator.SSHCommunicator interface
 
-func (c *SSHCommunicator) Start(cmd *Cmd) error {
+func (c *SSHCommunicator) Start(ctx context.Context, cmd *Cmd) error {
 	cmd.Init()
 
-	session, err := c.newSession()
+	session, err := c.newSession(ctx)
 	if err != nil {
 		return err
 	}
@@ -200,7 +314,7 @@ func (c *SSHCommunicator) Start(cmd *Cmd) error {
 	session.Stdout = cmd.Stdout
 	session.Stderr = cmd.Stderr
 
-	if !c.config.noPty {
+	if !c.config.noPty && !cmd.NoPty {
 		// Request a PTY
 		termModes := ssh.TerminalModes{
 			ssh.ECHO:          0,     // do not echo
@@ -208,37 +322,69 @@ func (c *SSHCommunicator) Start(cmd *Cmd) error {
 			ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
 		}
 
-		if err := session.RequestPty("xterm", 80, 40, termModes); err != nil {
+		err := c.untilDone(ctx, func() error {
+			return session.RequestPty("xterm", 80, 40, termModes)
+		})
+		if err != nil {
+			session.Close()
 			return err
 		}
 	}
 
+	timeout := cmd.Timeout
+	if timeout == 0 {
+		timeout = c.connInfo.RunTimeoutVal
+	}
+	cancel := func() {}
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
 	log.Printf("[DEBUG] starting remote command: %s", cmd.Command)
-	err = session.Start(strings.TrimSpace(cmd.Command) + "\n")
+	err = c.untilDone(ctx, func() error {
+		return session.Start(strings.TrimSpace(cmd.Command) + "\n")
+	})
 	if err != nil {
+		cancel()
+		session.Close()
 		return err
 	}
 
+	// Stop the remote process if the context is done before it exits
+	done := make(chan struct{})
+	go interrupt(ctx, session, cmd.Kill, c.client.Close, done, cmd.Command)
+
 	// Start a goroutine to wait for the session to end and set the
 	// exit boolean and status.
 	go func() {
 		defer session.Close()
+		defer cancel()
 
 		err := session.Wait()
+		close(done)
 		exitStatus := 0
 		if err != nil {
 			exitErr, ok := err.(*ssh.ExitError)
 			if ok {
+				// a non-zero exit status is reported through exitStatus
+				// alone, Err is reserved for failures to run the command.
 				exitStatus = exitErr.ExitStatus()
+				err = nil
+			} else if lost := c.lostErr(); lost != nil {
+				// the session died with the connection, say why
+				err = lost
 			}
 		}
 
+		// a command that failed after being signalled was stopped by us,
+		// because of cancellation or its timeout
+		if (err != nil || exitStatus != 0) && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+
 		cmd.SetExitStatus(exitStatus, err)
 		log.Printf("[DEBUG] remote command exited with '%d': %s", exitStatus, cmd.Command)
 	}()
 
 	return nil
 }
-
-
-
@@ -0,0 +1,258 @@
+package ssh
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestNewSessionCancel(t *testing.T) {
+	hostKey := newTestSigner(t)
+	conf := &ssh.ServerConfig{NoClientAuth: true}
+	conf.AddHostKey(hostKey)
+	srv := newTestServer(t, conf, unresponsive)
+
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		User:            "chef",
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	comm := &SSHCommunicator{
+		connInfo: &ConnectionInfo{Host: "unresponsive"},
+		client:   client,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := comm.newSession(ctx)
+		errc <- err
+	}()
+
+	select {
+	case err := <-errc:
+		if err != context.DeadlineExceeded {
+			t.Errorf("error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("newSession is still waiting for the channel open after its context expired")
+	}
+}
+
+// runTestCommand stands in for a shell: "exit N" exits with N, and "sleep"
+// runs until it is sent a signal, then exits with 128 plus its number.
+func runTestCommand(command string, signals <-chan string) int {
+	command = strings.TrimSpace(command)
+	if strings.HasPrefix(command, "exit ") {
+		status, _ := strconv.Atoi(strings.TrimPrefix(command, "exit "))
+		return status
+	}
+
+	select {
+	case sig := <-signals:
+		if sig == string(ssh.SIGKILL) {
+			return 137
+		}
+		return 143
+	case <-time.After(5 * time.Second):
+		return 0
+	}
+}
+
+func TestStart(t *testing.T) {
+	hostKey := newTestSigner(t)
+	conf := &ssh.ServerConfig{NoClientAuth: true}
+	conf.AddHostKey(hostKey)
+	srv := newTestServer(t, conf, execServer(runTestCommand))
+
+	cases := []struct {
+		name       string
+		command    string
+		runTimeout time.Duration
+		timeout    time.Duration
+
+		// cancelAfter, if set, cancels the command's context that long
+		// after it started
+		cancelAfter time.Duration
+
+		// err is nil for a clean exit
+		err *ExitError
+	}{
+		{name: "success", command: "exit 0"},
+		{
+			name:    "exit status",
+			command: "exit 37",
+			err:     &ExitError{Command: "exit 37", ExitStatus: 37},
+		},
+		{
+			name:       "past the run timeout",
+			command:    "sleep",
+			runTimeout: 100 * time.Millisecond,
+			err:        &ExitError{Command: "sleep", ExitStatus: 143, Err: context.DeadlineExceeded, TimedOut: true},
+		},
+		{
+			name:       "past the command timeout",
+			command:    "sleep",
+			runTimeout: time.Hour,
+			timeout:    100 * time.Millisecond,
+			err:        &ExitError{Command: "sleep", ExitStatus: 143, Err: context.DeadlineExceeded, TimedOut: true},
+		},
+		{
+			name:       "within the timeout",
+			command:    "exit 0",
+			runTimeout: time.Hour,
+		},
+		{
+			name:        "cancelled",
+			command:     "sleep",
+			runTimeout:  time.Hour,
+			cancelAfter: 100 * time.Millisecond,
+			err:         &ExitError{Command: "sleep", ExitStatus: 143, Err: context.Canceled, Cancelled: true},
+		},
+		{
+			name:        "cancelled after a failure",
+			command:     "exit 1",
+			cancelAfter: 500 * time.Millisecond,
+			err:         &ExitError{Command: "exit 1", ExitStatus: 1},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+				User:            "chef",
+				HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			comm := &SSHCommunicator{
+				connInfo: &ConnectionInfo{Host: "exec", RunTimeoutVal: c.runTimeout},
+				config:   &sshConfig{},
+				client:   client,
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if c.cancelAfter > 0 {
+				time.AfterFunc(c.cancelAfter, cancel)
+			}
+
+			cmd := &Cmd{Command: c.command, Timeout: c.timeout}
+			if err := comm.Start(ctx, cmd); err != nil {
+				t.Fatal(err)
+			}
+
+			errc := make(chan error, 1)
+			go func() { errc <- cmd.Wait() }()
+
+			select {
+			case err = <-errc:
+			case <-time.After(3 * time.Second):
+				t.Fatal("command is still running")
+			}
+			checkExitError(t, err, c.err)
+		})
+	}
+}
+
+// checkExitError fails the test unless err is an *ExitError equal to want,
+// or nil if want is.
+func checkExitError(t *testing.T, err error, want *ExitError) {
+	if want == nil {
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		return
+	}
+
+	exitErr, ok := err.(*ExitError)
+	if !ok {
+		t.Fatalf("error = %#v, want an *ExitError", err)
+	}
+	if *exitErr != *want {
+		t.Errorf("error = %+v, want %+v", *exitErr, *want)
+	}
+	if IsTimeout(err) != want.TimedOut {
+		t.Errorf("IsTimeout = %t, want %t", IsTimeout(err), want.TimedOut)
+	}
+	if IsCancelled(err) != want.Cancelled {
+		t.Errorf("IsCancelled = %t, want %t", IsCancelled(err), want.Cancelled)
+	}
+}
+
+func TestStartKill(t *testing.T) {
+	killed := make(chan string, 4)
+
+	// like a command running under sudo, signal requests from the login
+	// user are ignored and only Kill reaches it
+	run := func(command string, signals <-chan string) int {
+		select {
+		case sig := <-killed:
+			if sig == "KILL" {
+				return 137
+			}
+			return 143
+		case <-time.After(5 * time.Second):
+			return 0
+		}
+	}
+
+	hostKey := newTestSigner(t)
+	conf := &ssh.ServerConfig{NoClientAuth: true}
+	conf.AddHostKey(hostKey)
+	srv := newTestServer(t, conf, execServer(run))
+
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		User:            "chef",
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	comm := &SSHCommunicator{
+		connInfo: &ConnectionInfo{Host: "exec", RunTimeoutVal: 100 * time.Millisecond},
+		config:   &sshConfig{},
+		client:   client,
+	}
+
+	var sent []string
+	cmd := &Cmd{
+		Command: "sudo chef-client",
+		Kill: func(signal string) error {
+			sent = append(sent, signal)
+			killed <- signal
+			return nil
+		},
+	}
+	if err := comm.Start(context.Background(), cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- cmd.Wait() }()
+
+	select {
+	case err = <-errc:
+	case <-time.After(3 * time.Second):
+		t.Fatal("command is still running")
+	}
+	checkExitError(t, err, &ExitError{Command: "sudo chef-client", ExitStatus: 143, Err: context.DeadlineExceeded, TimedOut: true})
+	if len(sent) != 1 || sent[0] != "TERM" {
+		t.Errorf("Kill got %v, want [TERM]", sent)
+	}
+}
@@ -1,7 +1,10 @@
 package ssh
 
 import (
+	"context"
 	"io"
+	"strings"
+	"time"
 )
 
 // Cmd represents a remote command being prepared or run.
@@ -16,6 +19,19 @@ type Cmd struct {
 	Stdout io.Writer
 	Stderr io.Writer
 
+	// NoPty, if true, runs the command without a pty so that Stdin reaches
+	// the remote process verbatim, followed by EOF.
+	NoPty bool
+
+	// Timeout bounds how long the command may run before it is stopped. If
+	// zero, the communicator's run timeout applies.
+	Timeout time.Duration
+
+	// Kill, if set, is used instead of a signal request to send the command
+	// a signal ("TERM" or "KILL") when it has to be stopped. sshd signals
+	// as the login user, which may not signal a command running under sudo.
+	Kill func(signal string) error
+
 	exitStatus int
 
 	// Internal fields
@@ -45,8 +61,15 @@ func (c *Cmd) Wait() error {
 			Command:    c.Command,
 			ExitStatus: c.exitStatus,
 			Err:        c.err,
+			Cancelled:  c.err == context.Canceled,
+			TimedOut:   c.err == context.DeadlineExceeded,
 		}
 	}
 
 	return nil
 }
+
+// ShellQuote quotes s for use as a single word in a POSIX shell command.
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -1,6 +1,9 @@
 package ssh
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+)
 
 /****************
  Error definition
@@ -19,11 +22,41 @@ type ExitError struct {
 	Command    string
 	ExitStatus int
 	Err        error
+
+	// Cancelled is set when the command was stopped because its context
+	// was cancelled
+	Cancelled bool
+
+	// TimedOut is set when the command was stopped because it ran past its
+	// timeout
+	TimedOut bool
 }
 
 func (e *ExitError) Error() string {
+	if e.Cancelled {
+		return fmt.Sprintf("%q cancelled", e.Command)
+	}
+	if e.TimedOut {
+		return fmt.Sprintf("%q timed out", e.Command)
+	}
 	if e.Err != nil {
 		return fmt.Sprintf("error executing %q: %v", e.Command, e.Err)
 	}
 	return fmt.Sprintf("%q exit status: %d", e.Command, e.ExitStatus)
-}
\ No newline at end of file
+}
+
+// IsCancelled reports whether err means a command or connection attempt was
+// stopped because its context was cancelled.
+func IsCancelled(err error) bool {
+	if exitErr, ok := err.(*ExitError); ok {
+		return exitErr.Cancelled
+	}
+	return err == context.Canceled
+}
+
+// IsTimeout reports whether err means a command was stopped because it ran
+// past its timeout.
+func IsTimeout(err error) bool {
+	exitErr, ok := err.(*ExitError)
+	return ok && exitErr.TimedOut
+}
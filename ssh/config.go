@@ -3,36 +3,59 @@ package ssh
 import (
 	"encoding/pem"
 	"fmt"
-	"io/ioutil"
 	"net"
-	"os"
+	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/xanzy/ssh-agent"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/knownhosts"
 )
 
-
 type ConnectionInfo struct {
-	User       string
-	Password   string
-	PrivateKey string `mapstructure:"Private_Key"`
-	Host       string
-	HostKey    string `mapstructure:"Host_Key"`
-	Port       int
-	Agent      bool
-	Timeout    string
-	TimeoutVal time.Duration `mapstructure:"-"`
-
-	BastionUser       string `mapstructure:"Bastion_User"`
-	BastionPassword   string `mapstructure:"Bastion_Password"`
-	BastionPrivateKey string `mapstructure:"Bastion_Private_Key"`
-	BastionHost       string `mapstructure:"Bastion_Host"`
-	BastionHostKey    string `mapstructure:"Bastion_Host_Key"`
-	BastionPort       int    `mapstructure:"Bastion_Port"`
+	User                 string
+	Password             string
+	PrivateKey           string `mapstructure:"Private_Key"`
+	PrivateKeyPassphrase string `mapstructure:"Private_Key_Passphrase"`
+	PrivateKeyCert       string `mapstructure:"Private_Key_Cert"`
+	Host                 string
+	HostKey              string `mapstructure:"Host_Key"`
+	Port                 int
+	Agent                bool
+	Timeout              string
+	TimeoutVal           time.Duration `mapstructure:"-"`
+	RunTimeout           string        `mapstructure:"Run_Timeout"`
+	RunTimeoutVal        time.Duration `mapstructure:"-"`
+
+	BastionUser                 string `mapstructure:"Bastion_User"`
+	BastionPassword             string `mapstructure:"Bastion_Password"`
+	BastionPrivateKey           string `mapstructure:"Bastion_Private_Key"`
+	BastionPrivateKeyPassphrase string `mapstructure:"Bastion_Private_Key_Passphrase"`
+	BastionHost                 string `mapstructure:"Bastion_Host"`
+	BastionHostKey              string `mapstructure:"Bastion_Host_Key"`
+	BastionPort                 int    `mapstructure:"Bastion_Port"`
+
+	BastionKnownHosts  string `mapstructure:"Bastion_Known_Hosts"`
+	BastionHostKeyMode string `mapstructure:"Bastion_Host_Key_Mode"`
+
+	// JumpHosts, when set, replaces the bastion with a chain of hops
+	JumpHosts []JumpHost `mapstructure:"-"`
+
+	// KeepAliveInterval, if set, is the interval between keepalive requests
+	// and KeepAliveMaxMissed the number of unanswered requests after which
+	// the connection is considered dead
+	KeepAliveInterval  time.Duration `mapstructure:"-"`
+	KeepAliveMaxMissed int           `mapstructure:"-"`
 
 	AgentIdentity string `mapstructure:"Agent_Identity"`
+
+	TOTPSecret     string `mapstructure:"TOTP_Secret"`
+	PasswordPrompt string `mapstructure:"Password_Prompt"`
+	OTPPrompt      string `mapstructure:"OTP_Prompt"`
+
+	KnownHosts            string `mapstructure:"Known_Hosts"`
+	HostKeyMode           string `mapstructure:"Host_Key_Mode"`
+	StrictHostKeyChecking bool   `mapstructure:"Strict_Host_Key_Checking"`
 }
 
 /***********************************************
@@ -56,71 +79,165 @@ func connectToAgent(connInfo *ConnectionInfo) (*sshAgent, error) {
 		agent: agent,
 		conn:  conn,
 		id:    connInfo.AgentIdentity,
+		cert:  findIDCertificate(connInfo.AgentIdentity),
 	}, nil
 
 }
 
 // SSH Config Options
 type sshClientConfigOpts struct {
-	privateKey string
-	password   string
-	sshAgent   *sshAgent
-	user       string
-	host       string
-	hostKey    string
+	privateKey  string
+	passphrase  string
+	certificate string
+	password    string
+	totpSecret  string
+
+	// passwordPrompt and otpPrompt are regular expressions matching the
+	// keyboard-interactive prompts answered with the password and the
+	// current TOTP code respectively
+	passwordPrompt string
+	otpPrompt      string
+	sshAgent       *sshAgent
+	user           string
+	host           string
+	hostKey        hostKeyOpts
 }
 
-func readPrivateKey(pk string) (ssh.AuthMethod, error) {
-	// We parse the private key on our own first so that we can
-	// show a nicer error if the private key has a password.
-	block, _ := pem.Decode([]byte(pk))
-	if block == nil {
-		return nil, fmt.Errorf("Failed to read key %q: no key found", pk)
+func readPrivateKey(pk, passphrase, cert string) (ssh.AuthMethod, error) {
+	signer, err := parsePrivateKey(pk, passphrase)
+	if err != nil {
+		return nil, err
 	}
-	if block.Headers["Proc-Type"] == "4,ENCRYPTED" {
-		return nil, fmt.Errorf(
-			"Failed to read key %q: password protected keys are\n"+
-				"not supported. Please decrypt the key prior to use.", pk)
+
+	if cert == "" {
+		return ssh.PublicKeys(signer), nil
 	}
 
-	signer, err := ssh.ParsePrivateKey([]byte(pk))
+	c, err := parseCertificate([]byte(cert))
+	if err != nil {
+		return nil, err
+	}
+	certSigner, err := ssh.NewCertSigner(c, signer)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to parse key file %q: %s", pk, err)
+		return nil, fmt.Errorf("Failed to use certificate: %s", err)
 	}
 
-	return ssh.PublicKeys(signer), nil
+	// offer the certificate first, the plain key is the fallback
+	return ssh.PublicKeys(certSigner, signer), nil
 }
 
-func buildSSHClientConfig(opts sshClientConfigOpts) (*ssh.ClientConfig, error) {
-	hkCallback := ssh.InsecureIgnoreHostKey()
+const (
+	// DefaultPasswordPrompt matches keyboard-interactive password prompts
+	DefaultPasswordPrompt = `(?i)password`
 
-	if opts.hostKey != "" {
+	// DefaultOTPPrompt matches keyboard-interactive one-time code prompts
+	DefaultOTPPrompt = `(?i)(verification code|one[- ]time|otp|token|authenticator)`
+)
 
-		tf, err := ioutil.TempFile("", "drone_known_hosts")
-		if err != nil {
-			return nil, fmt.Errorf("failed to create temp known_hosts file: %s", err)
+// keyboardInteractive answers keyboard-interactive prompts with the password
+// or a TOTP code, depending on which prompt pattern matches. OTP prompts are
+// checked first as they often mention a password too.
+func keyboardInteractive(opts sshClientConfigOpts) (ssh.KeyboardInteractiveChallenge, error) {
+	passwordPrompt, otpPrompt := opts.passwordPrompt, opts.otpPrompt
+	if passwordPrompt == "" {
+		passwordPrompt = DefaultPasswordPrompt
+	}
+	if otpPrompt == "" {
+		otpPrompt = DefaultOTPPrompt
+	}
+
+	passwordRe, err := regexp.Compile(passwordPrompt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid password prompt pattern: %s", err)
+	}
+	otpRe, err := regexp.Compile(otpPrompt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTP prompt pattern: %s", err)
+	}
+
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i, q := range questions {
+			switch {
+			case opts.totpSecret != "" && otpRe.MatchString(q):
+				code, err := totp(opts.totpSecret, time.Now())
+				if err != nil {
+					return nil, err
+				}
+				answers[i] = code
+			case opts.password != "" && passwordRe.MatchString(q):
+				answers[i] = opts.password
+			default:
+				return nil, fmt.Errorf("no answer for keyboard-interactive prompt %q", q)
+			}
 		}
-		defer tf.Close()
-		defer os.RemoveAll(tf.Name())
+		return answers, nil
+	}, nil
+}
+
+// parseCertificate parses an OpenSSH user certificate in authorized_keys
+// format, as found in a -cert.pub file.
+func parseCertificate(data []byte) (*ssh.Certificate, error) {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse certificate: %s", err)
+	}
+
+	cert, ok := pk.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("Failed to parse certificate: %s is not a certificate", pk.Type())
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("Failed to parse certificate: not a user certificate")
+	}
+	return cert, nil
+}
 
-		if _, err := tf.WriteString(fmt.Sprintf("@cert-authority %s %s\n", opts.host, opts.hostKey)); err != nil {
-			return nil, fmt.Errorf("failed to write temp known_hosts file: %s", err)
+// parsePrivateKey parses a PEM or OpenSSH format private key, decrypting it
+// with passphrase when it is encrypted.
+func parsePrivateKey(pk, passphrase string) (ssh.Signer, error) {
+	// We parse the private key on our own first so that we can
+	// show a nicer error if the private key is not a key at all.
+	block, _ := pem.Decode([]byte(pk))
+	if block == nil {
+		return nil, fmt.Errorf("Failed to read key: no key found")
+	}
+
+	signer, err := ssh.ParsePrivateKey([]byte(pk))
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		if passphrase == "" {
+			return nil, fmt.Errorf(
+				"Failed to read key: the key is password protected\n" +
+					"and no passphrase is configured.")
 		}
-		tf.Sync()
 
-		hkCallback, err = knownhosts.New(tf.Name())
+		signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(pk), []byte(passphrase))
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("Failed to decrypt key: %s", err)
 		}
+		return signer, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse key file: %s", err)
+	}
+
+	return signer, nil
+}
+
+func buildSSHClientConfig(opts sshClientConfigOpts) (*ssh.ClientConfig, error) {
+	hkCallback, hkAlgorithms, err := hostKeyCallback(opts.host, opts.hostKey)
+	if err != nil {
+		return nil, err
 	}
 
 	conf := &ssh.ClientConfig{
-		HostKeyCallback: hkCallback,
-		User:            opts.user,
+		HostKeyCallback:   hkCallback,
+		HostKeyAlgorithms: hkAlgorithms,
+		User:              opts.user,
 	}
 
 	if opts.privateKey != "" {
-		pubKeyAuth, err := readPrivateKey(opts.privateKey)
+		pubKeyAuth, err := readPrivateKey(opts.privateKey, opts.passphrase, opts.certificate)
 		if err != nil {
 			return nil, err
 		}
@@ -131,6 +248,21 @@ func buildSSHClientConfig(opts sshClientConfigOpts) (*ssh.ClientConfig, error) {
 		conf.Auth = append(conf.Auth, ssh.Password(opts.password))
 	}
 
+	if opts.totpSecret != "" {
+		// a bad secret would otherwise only show up as a failed login
+		if _, err := totp(opts.totpSecret, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.password != "" || opts.totpSecret != "" {
+		challenge, err := keyboardInteractive(opts)
+		if err != nil {
+			return nil, err
+		}
+		conf.Auth = append(conf.Auth, ssh.KeyboardInteractive(challenge))
+	}
+
 	if opts.sshAgent != nil {
 		conf.Auth = append(conf.Auth, opts.sshAgent.Auth())
 	}
@@ -150,53 +282,107 @@ type sshConfig struct {
 	// noPty, if true, will not request a pty from the remote end.
 	noPty bool
 
+	// dialTimeout bounds the dial and handshake of a connection attempt
+	dialTimeout time.Duration
+
 	sshAgent *sshAgent
 }
+
 func prepareSSHConfig(connInfo *ConnectionInfo) (*sshConfig, error) {
 	sshAgent, err := connectToAgent(connInfo)
 	if err != nil {
 		return nil, err
 	}
 
-	host := fmt.Sprintf("%s:%d", connInfo.Host, connInfo.Port)
+	host := net.JoinHostPort(connInfo.Host, strconv.Itoa(connInfo.Port))
 
 	sshConf, err := buildSSHClientConfig(sshClientConfigOpts{
-		user:       connInfo.User,
-		host:       host,
-		privateKey: connInfo.PrivateKey,
-		password:   connInfo.Password,
-		hostKey:    connInfo.HostKey,
-		sshAgent:   sshAgent,
+		user:           connInfo.User,
+		host:           host,
+		privateKey:     connInfo.PrivateKey,
+		passphrase:     connInfo.PrivateKeyPassphrase,
+		certificate:    connInfo.PrivateKeyCert,
+		totpSecret:     connInfo.TOTPSecret,
+		passwordPrompt: connInfo.PasswordPrompt,
+		otpPrompt:      connInfo.OTPPrompt,
+		password:       connInfo.Password,
+		hostKey: hostKeyOpts{
+			hop:        "target",
+			hostKey:    connInfo.HostKey,
+			mode:       connInfo.HostKeyMode,
+			knownHosts: connInfo.KnownHosts,
+			strict:     connInfo.StrictHostKeyChecking,
+		},
+		sshAgent: sshAgent,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	connectFunc := ConnectFunc("tcp", host)
+	dialTimeout := DefaultDialTimeout
+	if connInfo.TimeoutVal > 0 && connInfo.TimeoutVal < dialTimeout {
+		dialTimeout = connInfo.TimeoutVal
+	}
 
-	var bastionConf *ssh.ClientConfig
-	if connInfo.BastionHost != "" {
-		bastionHost := fmt.Sprintf("%s:%d", connInfo.BastionHost, connInfo.BastionPort)
+	connectFunc := ConnectFunc("tcp", host, dialTimeout)
+
+	jumps := connInfo.JumpHosts
+	hopName := "jump host"
+	if len(jumps) == 0 && connInfo.BastionHost != "" {
+		hopName = "bastion"
+		jumps = []JumpHost{{
+			User:                 connInfo.BastionUser,
+			Host:                 connInfo.BastionHost,
+			Port:                 connInfo.BastionPort,
+			Password:             connInfo.BastionPassword,
+			PrivateKey:           connInfo.BastionPrivateKey,
+			PrivateKeyPassphrase: connInfo.BastionPrivateKeyPassphrase,
+			HostKey:              connInfo.BastionHostKey,
+			HostKeyMode:          connInfo.BastionHostKeyMode,
+			KnownHosts:           connInfo.BastionKnownHosts,
+		}}
+	}
 
-		bastionConf, err = buildSSHClientConfig(sshClientConfigOpts{
-			user:       connInfo.BastionUser,
-			host:       bastionHost,
-			privateKey: connInfo.BastionPrivateKey,
-			password:   connInfo.BastionPassword,
-			hostKey:    connInfo.HostKey,
-			sshAgent:   sshAgent,
-		})
-		if err != nil {
-			return nil, err
+	if len(jumps) > 0 {
+		hops := make([]Hop, 0, len(jumps))
+		for i, j := range jumps {
+			jumpHost := net.JoinHostPort(j.Host, strconv.Itoa(j.Port))
+
+			hop := hopName
+			if len(jumps) > 1 {
+				hop = fmt.Sprintf("%s %d", hopName, i+1)
+			}
+
+			jumpConf, err := buildSSHClientConfig(sshClientConfigOpts{
+				user:       j.User,
+				host:       jumpHost,
+				privateKey: j.PrivateKey,
+				passphrase: j.PrivateKeyPassphrase,
+				password:   j.Password,
+				hostKey: hostKeyOpts{
+					hop:        hop,
+					hostKey:    j.HostKey,
+					mode:       j.HostKeyMode,
+					knownHosts: j.KnownHosts,
+					strict:     connInfo.StrictHostKeyChecking,
+				},
+				sshAgent: sshAgent,
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			hops = append(hops, Hop{Proto: "tcp", Addr: jumpHost, Config: jumpConf})
 		}
 
-		connectFunc = BastionConnectFunc("tcp", bastionHost, bastionConf, "tcp", host)
+		connectFunc = JumpConnectFunc(hops, "tcp", host, dialTimeout)
 	}
 
 	config := &sshConfig{
-		config:     sshConf,
-		connection: connectFunc,
-		sshAgent:   sshAgent,
+		config:      sshConf,
+		connection:  connectFunc,
+		dialTimeout: dialTimeout,
+		sshAgent:    sshAgent,
 	}
 	return config, nil
 }
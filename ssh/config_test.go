@@ -0,0 +1,364 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParsePrivateKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
+	})
+	// legacy encrypted PEM, as written by ssh-keygen -m PEM
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), []byte("secret"), x509.PEMCipherAES128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedPEM := pem.EncodeToMemory(block)
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err = ssh.MarshalPrivateKey(edKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainOpenSSH := pem.EncodeToMemory(block)
+	block, err = ssh.MarshalPrivateKeyWithPassphrase(edKey, "", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedOpenSSH := pem.EncodeToMemory(block)
+
+	rsaPub, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, err := ssh.NewPublicKey(edKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name       string
+		key        []byte
+		passphrase string
+		pub        ssh.PublicKey
+
+		// err is a prefix of the expected error
+		err string
+	}{
+		{name: "pem", key: plainPEM, pub: rsaPub},
+		{name: "encrypted pem", key: encryptedPEM, passphrase: "secret", pub: rsaPub},
+		{name: "encrypted pem with wrong passphrase", key: encryptedPEM, passphrase: "wrong", err: "Failed to decrypt key: "},
+		{name: "encrypted pem without passphrase", key: encryptedPEM, err: "Failed to read key: the key is password protected"},
+		{name: "pem with unneeded passphrase", key: plainPEM, passphrase: "secret", pub: rsaPub},
+		{name: "openssh", key: plainOpenSSH, pub: edPub},
+		{name: "encrypted openssh", key: encryptedOpenSSH, passphrase: "secret", pub: edPub},
+		{name: "encrypted openssh with wrong passphrase", key: encryptedOpenSSH, passphrase: "wrong", err: "Failed to decrypt key: "},
+		{name: "encrypted openssh without passphrase", key: encryptedOpenSSH, err: "Failed to read key: the key is password protected"},
+		{name: "openssh with unneeded passphrase", key: plainOpenSSH, passphrase: "secret", pub: edPub},
+		{name: "not a key", key: []byte("ssh-ed25519 AAAA"), err: "Failed to read key: no key found"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			signer, err := parsePrivateKey(string(c.key), c.passphrase)
+			if c.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), c.err) {
+					t.Fatalf("error = %v, want %q", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := signer.PublicKey().Marshal(); string(got) != string(c.pub.Marshal()) {
+				t.Errorf("parsed a different key")
+			}
+		})
+	}
+}
+
+// newTestCert returns an OpenSSH certificate of certType for key, signed by
+// ca, in authorized_keys format.
+func newTestCert(t *testing.T, key ssh.PublicKey, ca ssh.Signer, certType uint32) string {
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        certType,
+		KeyId:           "chef",
+		ValidPrincipals: []string{"chef"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return string(ssh.MarshalAuthorizedKey(cert))
+}
+
+// offeredKeys authenticates to a test server with auth and returns the public
+// keys offered, in order. The server accepts none of them.
+func offeredKeys(t *testing.T, auth ssh.AuthMethod) []ssh.PublicKey {
+	var (
+		mu      sync.Mutex
+		offered []ssh.PublicKey
+	)
+	conf := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			offered = append(offered, key)
+			return nil, fmt.Errorf("key not accepted")
+		},
+	}
+	conf.AddHostKey(newTestSigner(t))
+	srv := newTestServer(t, conf, unresponsive)
+
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		User:            "chef",
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		client.Close()
+		t.Fatal("authenticated without an accepted key")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return offered
+}
+
+func TestReadPrivateKey(t *testing.T) {
+	ca := newTestSigner(t)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(edKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := string(pem.EncodeToMemory(block))
+	signer, err := ssh.NewSignerFromKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := signer.PublicKey()
+
+	userCert := newTestCert(t, pub, ca, ssh.UserCert)
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(userCert))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		cert string
+
+		// offered are the keys offered to the server, in order
+		offered []ssh.PublicKey
+		err     string
+	}{
+		{name: "no certificate", offered: []ssh.PublicKey{pub}},
+		{name: "user certificate", cert: userCert, offered: []ssh.PublicKey{parsed, pub}},
+		{
+			name: "host certificate",
+			cert: newTestCert(t, pub, ca, ssh.HostCert),
+			err:  "Failed to parse certificate: not a user certificate",
+		},
+		{
+			name: "plain public key",
+			cert: string(ssh.MarshalAuthorizedKey(pub)),
+			err:  "Failed to parse certificate: ssh-ed25519 is not a certificate",
+		},
+		{
+			name: "certificate for another key",
+			cert: newTestCert(t, newTestSigner(t).PublicKey(), ca, ssh.UserCert),
+			err:  "Failed to use certificate: ",
+		},
+		{name: "not a certificate", cert: "ssh-ed25519-cert-v01@openssh.com AAAA", err: "Failed to parse certificate: "},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			auth, err := readPrivateKey(key, "", c.cert)
+			if c.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), c.err) {
+					t.Fatalf("error = %v, want %q", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			offered := offeredKeys(t, auth)
+			if len(offered) != len(c.offered) {
+				t.Fatalf("offered %d keys, want %d", len(offered), len(c.offered))
+			}
+			for i := range offered {
+				if string(offered[i].Marshal()) != string(c.offered[i].Marshal()) {
+					t.Errorf("key %d offered is a %s, want a %s", i, offered[i].Type(), c.offered[i].Type())
+				}
+			}
+		})
+	}
+}
+
+func TestKeyboardInteractive(t *testing.T) {
+	// RFC 6238 test secret, see TestTOTP
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+	// otp stands in for the current TOTP code in answers
+	const otp = "<otp>"
+
+	cases := []struct {
+		name      string
+		opts      sshClientConfigOpts
+		questions []string
+		answers   []string
+		err       string
+	}{
+		{
+			name:      "password and otp",
+			opts:      sshClientConfigOpts{password: "secret", totpSecret: secret},
+			questions: []string{"Password: ", "Verification code: "},
+			answers:   []string{"secret", otp},
+		},
+		{
+			name:      "otp prompt mentioning the password",
+			opts:      sshClientConfigOpts{password: "secret", totpSecret: secret},
+			questions: []string{"One-time password: "},
+			answers:   []string{otp},
+		},
+		{
+			name:      "password only",
+			opts:      sshClientConfigOpts{password: "secret"},
+			questions: []string{"Password: "},
+			answers:   []string{"secret"},
+		},
+		{
+			name:      "otp prompt without a secret",
+			opts:      sshClientConfigOpts{password: "secret"},
+			questions: []string{"Verification code: "},
+			err:       `no answer for keyboard-interactive prompt "Verification code: "`,
+		},
+		{
+			name: "custom prompts",
+			opts: sshClientConfigOpts{
+				password:       "secret",
+				totpSecret:     secret,
+				passwordPrompt: `^Passphrase`,
+				otpPrompt:      `^Duo code`,
+			},
+			questions: []string{"Passphrase for chef: ", "Duo code: "},
+			answers:   []string{"secret", otp},
+		},
+		{
+			name:      "default prompt replaced",
+			opts:      sshClientConfigOpts{password: "secret", passwordPrompt: `^Passphrase`},
+			questions: []string{"Password: "},
+			err:       `no answer for keyboard-interactive prompt "Password: "`,
+		},
+		{
+			name:      "unmatched prompt",
+			opts:      sshClientConfigOpts{password: "secret", totpSecret: secret},
+			questions: []string{"Password: ", "Favourite colour: "},
+			err:       `no answer for keyboard-interactive prompt "Favourite colour: "`,
+		},
+		{
+			name:      "no questions",
+			opts:      sshClientConfigOpts{password: "secret"},
+			questions: []string{},
+			answers:   []string{},
+		},
+		{
+			name: "invalid password prompt",
+			opts: sshClientConfigOpts{password: "secret", passwordPrompt: "("},
+			err:  "invalid password prompt pattern: error parsing regexp: missing closing ): `(`",
+		},
+		{
+			name: "invalid otp prompt",
+			opts: sshClientConfigOpts{totpSecret: secret, otpPrompt: "["},
+			err:  "invalid OTP prompt pattern: error parsing regexp: missing closing ]: `[`",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			challenge, err := keyboardInteractive(c.opts)
+			if err != nil {
+				checkErr(t, err, c.err)
+				return
+			}
+
+			// the code may roll over during the challenge, either one will do
+			before, _ := totp(secret, time.Now())
+			answers, err := challenge("chef", "", c.questions, make([]bool, len(c.questions)))
+			after, _ := totp(secret, time.Now())
+			checkErr(t, err, c.err)
+			if c.err != "" {
+				return
+			}
+
+			if len(answers) != len(c.answers) {
+				t.Fatalf("answers = %q, want %q", answers, c.answers)
+			}
+			for i, a := range answers {
+				want := c.answers[i]
+				if want == otp && (a == before || a == after) {
+					continue
+				}
+				if a != want {
+					t.Errorf("answer to %q = %q, want %q", c.questions[i], a, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildSSHClientConfigTOTP(t *testing.T) {
+	cases := []struct {
+		name   string
+		secret string
+		err    string
+	}{
+		{name: "valid secret", secret: "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"},
+		{name: "invalid secret", secret: "not base32!", err: "invalid TOTP secret: "},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf, err := buildSSHClientConfig(sshClientConfigOpts{user: "chef", host: "127.0.0.1", totpSecret: c.secret})
+			if c.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), c.err) {
+					t.Fatalf("error = %v, want %q", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(conf.Auth) != 1 {
+				t.Errorf("got %d auth methods, want keyboard-interactive only", len(conf.Auth))
+			}
+		})
+	}
+}
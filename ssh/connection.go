@@ -1,19 +1,23 @@
 package ssh
 
 import (
-	"net"
-	"time"
-	"log"
 	"fmt"
 	"golang.org/x/crypto/ssh"
+	"log"
+	"net"
+	"sync"
+	"time"
 )
 
+// DefaultDialTimeout bounds a single connection attempt
+const DefaultDialTimeout = 15 * time.Second
+
 // ConnectFunc is a convenience method for returning a function
 // that just uses net.Dial to communicate with the remote end that
 // is suitable for use with the SSH communicator configuration.
-func ConnectFunc(network, addr string) func() (net.Conn, error) {
+func ConnectFunc(network, addr string, timeout time.Duration) func() (net.Conn, error) {
 	return func() (net.Conn, error) {
-		c, err := net.DialTimeout(network, addr, 15*time.Second)
+		c, err := net.DialTimeout(network, addr, timeout)
 		if err != nil {
 			return nil, err
 		}
@@ -34,34 +38,129 @@ func BastionConnectFunc(
 	bConf *ssh.ClientConfig,
 	proto string,
 	addr string) func() (net.Conn, error) {
+	return JumpConnectFunc([]Hop{{Proto: bProto, Addr: bAddr, Config: bConf}}, proto, addr, DefaultDialTimeout)
+}
+
+// Hop is a single SSH server in a chain of jump hosts.
+type Hop struct {
+	Proto  string
+	Addr   string
+	Config *ssh.ClientConfig
+}
+
+// JumpConnectFunc is a convenience method for returning a function that
+// connects to a host through an ordered chain of jump hosts, each one dialed
+// through the previous one. timeout bounds each dial and handshake along the
+// way.
+func JumpConnectFunc(hops []Hop, proto, addr string, timeout time.Duration) func() (net.Conn, error) {
 	return func() (net.Conn, error) {
-		log.Printf("[DEBUG] Connecting to bastion: %s", bAddr)
-		bastion, err := ssh.Dial(bProto, bAddr, bConf)
-		if err != nil {
-			return nil, fmt.Errorf("Error connecting to bastion: %s", err)
+		var base net.Conn
+		var clients []*ssh.Client
+		closeAll := func() {
+			for i := len(clients) - 1; i >= 0; i-- {
+				clients[i].Close()
+			}
 		}
 
-		log.Printf("[DEBUG] Connecting via bastion (%s) to host: %s", bAddr, addr)
-		conn, err := bastion.Dial(proto, addr)
+		for i, hop := range hops {
+			log.Printf("[DEBUG] Connecting to jump host %d: %s", i+1, hop.Addr)
+
+			err := withHostKeyRetry(hop.Config, func(conf *ssh.ClientConfig) error {
+				var conn net.Conn
+				var err error
+				if i == 0 {
+					conn, err = net.DialTimeout(hop.Proto, hop.Addr, timeout)
+					base = conn
+				} else {
+					err = withTimeout(base, timeout, func() (err error) {
+						conn, err = clients[i-1].Dial(hop.Proto, hop.Addr)
+						return err
+					})
+				}
+				if err != nil {
+					return err
+				}
+
+				var sshConn ssh.Conn
+				var chans <-chan ssh.NewChannel
+				var reqs <-chan *ssh.Request
+				err = withTimeout(base, timeout, func() (err error) {
+					sshConn, chans, reqs, err = ssh.NewClientConn(conn, hop.Addr, conf)
+					return err
+				})
+				if err != nil {
+					conn.Close()
+					return err
+				}
+				clients = append(clients, ssh.NewClient(sshConn, chans, reqs))
+				return nil
+			})
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("Error connecting to jump host %s: %s", hop.Addr, err)
+			}
+		}
+
+		log.Printf("[DEBUG] Connecting via %d jump hosts to host: %s", len(hops), addr)
+		var conn net.Conn
+		err := withTimeout(base, timeout, func() (err error) {
+			conn, err = clients[len(clients)-1].Dial(proto, addr)
+			return err
+		})
 		if err != nil {
-			bastion.Close()
+			closeAll()
 			return nil, err
 		}
 
-		// Wrap it up so we close both things properly
+		// Wrap it up so we close everything properly
 		return &bastionConn{
-			Conn:    conn,
-			Bastion: bastion,
+			Conn:  conn,
+			Jumps: clients,
 		}, nil
 	}
 }
 
+// withTimeout runs step, closing base if it takes longer than timeout.
+// Forwarded channels do not support deadlines, so tearing down the first
+// hop's TCP connection, and with it every hop on top, is the only way to
+// stop a jump host that stops answering.
+func withTimeout(base net.Conn, timeout time.Duration, step func() error) error {
+	t := time.AfterFunc(timeout, func() { base.Close() })
+	err := step()
+	if !t.Stop() {
+		return fmt.Errorf("i/o timeout after %s", timeout)
+	}
+	return err
+}
+
 type bastionConn struct {
 	net.Conn
-	Bastion *ssh.Client
+	Jumps []*ssh.Client
+
+	mu    sync.Mutex
+	timer *time.Timer
 }
 
 func (c *bastionConn) Close() error {
-	c.Conn.Close()
-	return c.Bastion.Close()
-}
\ No newline at end of file
+	err := c.Conn.Close()
+	for i := len(c.Jumps) - 1; i >= 0; i-- {
+		err = c.Jumps[i].Close()
+	}
+	return err
+}
+
+// SetDeadline closes the connection once t passes, since the forwarded
+// channel underneath does not support deadlines. A zero t clears it.
+func (c *bastionConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if !t.IsZero() {
+		c.timer = time.AfterFunc(time.Until(t), func() { c.Close() })
+	}
+	return nil
+}
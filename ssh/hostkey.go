@@ -0,0 +1,299 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host key modes, selecting how a configured host key is interpreted.
+const (
+	HostKeyModeAuto        = "auto"
+	HostKeyModeKey         = "key"
+	HostKeyModeFingerprint = "fingerprint"
+	HostKeyModeCA          = "ca"
+)
+
+// hostCertAlgorithms are the host certificate algorithms, in the order
+// OpenSSH prefers them
+var hostCertAlgorithms = []string{
+	ssh.CertAlgoED25519v01,
+	ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+	ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01,
+	ssh.CertAlgoDSAv01,
+}
+
+// hostKeyAlgorithms are all host key algorithms, in the order OpenSSH
+// prefers them. The x/crypto default puts ed25519 last.
+var hostKeyAlgorithms = append(append([]string{}, hostCertAlgorithms...),
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA,
+	ssh.KeyAlgoDSA,
+)
+
+// Host key verification options
+type hostKeyOpts struct {
+	// hop names the connection being verified in errors, e.g. "bastion"
+	hop string
+
+	// hostKey holds one or more public keys, SHA256 fingerprints or
+	// @cert-authority lines, one per line.
+	hostKey string
+
+	// mode selects how hostKey is interpreted, see the HostKeyMode constants
+	mode string
+
+	// knownHosts is the path to an OpenSSH known_hosts file
+	knownHosts string
+
+	// strict refuses to connect when there is nothing to verify against
+	strict bool
+}
+
+// hostKeyError is returned by the host key callback when the server's key
+// matches none of the configured ones.
+type hostKeyError struct {
+	hop      string
+	hostname string
+	key      ssh.PublicKey
+	errs     []string
+}
+
+func (e *hostKeyError) Error() string {
+	return fmt.Sprintf("%s host key verification failed for %s (%s %s): %s",
+		e.hop, e.hostname, e.key.Type(), ssh.FingerprintSHA256(e.key), strings.Join(e.errs, "; "))
+}
+
+// hostKeyCallback builds a callback that accepts the server when its key
+// matches any of the configured keys, fingerprints, certificate authorities
+// or known_hosts entries. It also returns the host key algorithms to offer,
+// so that the server sends a key of a type that can match; nil leaves the
+// x/crypto default.
+func hostKeyCallback(host string, opts hostKeyOpts) (ssh.HostKeyCallback, []string, error) {
+	var callbacks []ssh.HostKeyCallback
+	var algs []string
+
+	if opts.knownHosts != "" {
+		cb, err := knownhosts.New(opts.knownHosts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s known_hosts file %q: %s", opts.hop, opts.knownHosts, err)
+		}
+		callbacks = append(callbacks, cb)
+		algs = append(algs, knownHostAlgorithms(cb, host)...)
+	}
+
+	for _, line := range strings.Split(opts.hostKey, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		cb, lineAlgs, err := hostKeyLineCallback(line, opts.mode)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", opts.hop, err)
+		}
+		callbacks = append(callbacks, cb)
+		algs = append(algs, lineAlgs...)
+	}
+
+	if len(callbacks) == 0 {
+		if opts.strict {
+			return nil, nil, fmt.Errorf("strict host key checking is enabled but no host key or known_hosts file is configured for %s %s", opts.hop, host)
+		}
+		log.Printf("[WARN] no host key configured for %s %s, skipping host key verification", opts.hop, host)
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		var errs []string
+		for _, cb := range callbacks {
+			err := cb(hostname, remote, key)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err.Error())
+		}
+		return &hostKeyError{hop: opts.hop, hostname: hostname, key: key, errs: errs}
+	}, preferredHostKeyAlgorithms(algs), nil
+}
+
+// hostKeyLineCallback returns a callback verifying against a single host key
+// setting line, and the host key algorithms that can match it. A fingerprint
+// does not tell the key type, so it can match any.
+func hostKeyLineCallback(line, mode string) (ssh.HostKeyCallback, []string, error) {
+	if mode == "" || mode == HostKeyModeAuto {
+		switch {
+		case strings.HasPrefix(line, "SHA256:"):
+			mode = HostKeyModeFingerprint
+		case strings.HasPrefix(line, "@cert-authority"):
+			mode = HostKeyModeCA
+		default:
+			mode = HostKeyModeKey
+		}
+	}
+
+	switch mode {
+	case HostKeyModeFingerprint:
+		want := strings.TrimRight(line, "=")
+		if !strings.HasPrefix(want, "SHA256:") {
+			return nil, nil, fmt.Errorf("invalid host key fingerprint %q: expected SHA256:...", line)
+		}
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if got := ssh.FingerprintSHA256(key); got != want {
+				return fmt.Errorf("fingerprint %s does not match %s", got, want)
+			}
+			return nil
+		}, hostKeyAlgorithms, nil
+
+	case HostKeyModeCA:
+		ca, err := parseHostKey(strings.TrimSpace(strings.TrimPrefix(line, "@cert-authority")))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid host certificate authority %q: %s", line, err)
+		}
+		checker := &ssh.CertChecker{
+			IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+				return bytes.Equal(auth.Marshal(), ca.Marshal())
+			},
+		}
+		return checker.CheckHostKey, hostCertAlgorithms, nil
+
+	case HostKeyModeKey:
+		pk, err := parseHostKey(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid host key %q: %s", line, err)
+		}
+		return ssh.FixedHostKey(pk), keyTypeAlgorithms(pk.Type()), nil
+	}
+
+	return nil, nil, fmt.Errorf("invalid host key mode %q, expected one of auto, key, fingerprint or ca", mode)
+}
+
+// knownHostAlgorithms returns the host key algorithms of the keys the
+// known_hosts callback cb lists for host. Asked to verify a key no file can
+// hold, the callback reports the keys it knows. Only @cert-authority lines,
+// or none at all, leave every algorithm open.
+func knownHostAlgorithms(cb ssh.HostKeyCallback, host string) []string {
+	probe, err := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		return hostKeyAlgorithms
+	}
+
+	var keyErr *knownhosts.KeyError
+	if !errors.As(cb(host, &net.TCPAddr{IP: net.IPv4zero}, probe), &keyErr) || len(keyErr.Want) == 0 {
+		return hostKeyAlgorithms
+	}
+
+	var algs []string
+	for _, k := range keyErr.Want {
+		algs = append(algs, keyTypeAlgorithms(k.Key.Type())...)
+	}
+	return algs
+}
+
+// keyTypeAlgorithms returns the host key algorithms that use keys of the
+// given type. An RSA key signs with SHA-2 as well as SHA-1.
+func keyTypeAlgorithms(keyType string) []string {
+	switch keyType {
+	case ssh.KeyAlgoRSA:
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	case ssh.CertAlgoRSAv01:
+		return []string{ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01}
+	}
+	return []string{keyType}
+}
+
+// preferredHostKeyAlgorithms returns the algorithms of algs that x/crypto
+// supports, without duplicates and in the order OpenSSH prefers them.
+func preferredHostKeyAlgorithms(algs []string) []string {
+	var preferred []string
+	for _, a := range hostKeyAlgorithms {
+		for _, b := range algs {
+			if a == b {
+				preferred = append(preferred, a)
+				break
+			}
+		}
+	}
+	return preferred
+}
+
+// retryHostKeyAlgorithms returns the host key algorithms to offer in another
+// handshake after one offering algs failed with err, or nil if there is no
+// point in another. A server only sends its key for the first algorithm both
+// sides support, so when that key does not verify, a key of another type
+// may still match.
+func retryHostKeyAlgorithms(algs []string, err error) []string {
+	var hkErr *hostKeyError
+	if !errors.As(err, &hkErr) {
+		return nil
+	}
+
+	tried := keyTypeAlgorithms(hkErr.key.Type())
+	var next []string
+	for _, a := range algs {
+		if !contains(tried, a) {
+			next = append(next, a)
+		}
+	}
+	return next
+}
+
+// withHostKeyRetry runs attempt, a connection and handshake using conf, and
+// again with the algorithms of every key type the server offered but failed
+// to verify removed, until one verifies or no algorithm is left.
+func withHostKeyRetry(conf *ssh.ClientConfig, attempt func(*ssh.ClientConfig) error) error {
+	var mismatch error
+	for {
+		err := attempt(conf)
+		if err == nil {
+			return nil
+		}
+
+		next := retryHostKeyAlgorithms(conf.HostKeyAlgorithms, err)
+		if len(next) == 0 {
+			// running out of key types says less than the last mismatch
+			if mismatch != nil && strings.Contains(err.Error(), "no common algorithm") {
+				return mismatch
+			}
+			return err
+		}
+
+		log.Printf("[DEBUG] %s, retrying with host key algorithms %s", err, strings.Join(next, ","))
+		mismatch = err
+		retry := *conf
+		retry.HostKeyAlgorithms = next
+		conf = &retry
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHostKey parses a public key in authorized_keys format, optionally
+// preceded by the host patterns of a known_hosts line.
+func parseHostKey(s string) (ssh.PublicKey, error) {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err == nil {
+		return pk, nil
+	}
+
+	_, _, pk, _, _, khErr := ssh.ParseKnownHosts([]byte(s))
+	if khErr == nil {
+		return pk, nil
+	}
+
+	return nil, err
+}
@@ -0,0 +1,221 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestHostKeyVerification(t *testing.T) {
+	ed25519Key := newTestSigner(t)
+	ecdsaKey := newECDSASigner(t)
+	rsaKey := newRSASigner(t)
+	otherKey := newTestSigner(t)
+
+	ca := newTestSigner(t)
+	cert := &ssh.Certificate{
+		Key:             ed25519Key.PublicKey(),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"127.0.0.1"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, ed25519Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server offers every key, like an OpenSSH server with default
+	// host keys and a host certificate
+	conf := &ssh.ServerConfig{NoClientAuth: true}
+	for _, k := range []ssh.Signer{ecdsaKey, ed25519Key, rsaKey, certSigner} {
+		conf.AddHostKey(k)
+	}
+	srv := newTestServer(t, conf, unresponsive)
+	host, portStr, _ := net.SplitHostPort(srv.addr)
+	port, _ := strconv.Atoi(portStr)
+
+	dir, err := ioutil.TempDir("", "known-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	knownHosts := func(name string, hosts []string, key ssh.PublicKey) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(knownhosts.Line(hosts, key)+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	self := []string{knownhosts.Normalize(srv.addr)}
+
+	authorizedKey := func(k ssh.Signer) string {
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k.PublicKey())))
+	}
+	fingerprint := func(k ssh.Signer) string {
+		return ssh.FingerprintSHA256(k.PublicKey())
+	}
+
+	cases := []struct {
+		name       string
+		hostKey    string
+		mode       string
+		knownHosts string
+		strict     bool
+		configErr  string
+		connectErr string
+	}{
+		{name: "ed25519 key", hostKey: authorizedKey(ed25519Key)},
+		{name: "ecdsa key", hostKey: authorizedKey(ecdsaKey)},
+		{name: "rsa key", hostKey: authorizedKey(rsaKey)},
+		{name: "key in key mode", hostKey: authorizedKey(rsaKey), mode: HostKeyModeKey},
+		{name: "known_hosts line as key", hostKey: knownhosts.Line(self, ed25519Key.PublicKey())},
+		{name: "one of several keys", hostKey: authorizedKey(otherKey) + "\n" + authorizedKey(rsaKey)},
+		{name: "wrong key", hostKey: authorizedKey(otherKey), connectErr: "target host key verification failed"},
+		{name: "ed25519 fingerprint", hostKey: fingerprint(ed25519Key)},
+		{name: "ecdsa fingerprint", hostKey: fingerprint(ecdsaKey)},
+		{name: "rsa fingerprint", hostKey: fingerprint(rsaKey), mode: HostKeyModeFingerprint},
+		{name: "wrong fingerprint", hostKey: fingerprint(otherKey), connectErr: "target host key verification failed"},
+		{name: "invalid fingerprint", hostKey: "MD5:00:11", mode: HostKeyModeFingerprint, configErr: "invalid host key fingerprint"},
+		{name: "certificate authority", hostKey: "@cert-authority " + authorizedKey(ca)},
+		{name: "certificate authority in ca mode", hostKey: authorizedKey(ca), mode: HostKeyModeCA},
+		{name: "wrong certificate authority", hostKey: "@cert-authority " + authorizedKey(otherKey), connectErr: "target host key verification failed"},
+		{name: "known_hosts", knownHosts: knownHosts("ed25519", self, ed25519Key.PublicKey())},
+		{name: "known_hosts rsa", knownHosts: knownHosts("rsa", self, rsaKey.PublicKey())},
+		{
+			name:       "known_hosts without the host",
+			knownHosts: knownHosts("other", []string{"other.example.com"}, ed25519Key.PublicKey()),
+			connectErr: "target host key verification failed",
+		},
+		{
+			name:       "known_hosts with another key",
+			knownHosts: knownHosts("wrong", self, otherKey.PublicKey()),
+			connectErr: "target host key verification failed",
+		},
+		{name: "missing known_hosts", knownHosts: filepath.Join(dir, "missing"), configErr: "failed to read target known_hosts file"},
+		{name: "strict with key", hostKey: fingerprint(rsaKey), strict: true},
+		{name: "strict without key", strict: true, configErr: "strict host key checking is enabled"},
+		{name: "no key", hostKey: ""},
+		{name: "invalid mode", hostKey: authorizedKey(rsaKey), mode: "pinned", configErr: "invalid host key mode"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			comm, err := New(&ConnectionInfo{
+				User:                  "chef",
+				Host:                  host,
+				Port:                  port,
+				HostKey:               c.hostKey,
+				HostKeyMode:           c.mode,
+				KnownHosts:            c.knownHosts,
+				StrictHostKeyChecking: c.strict,
+			})
+			checkErrContains(t, err, c.configErr)
+			if err != nil {
+				return
+			}
+
+			err = comm.connect(context.Background())
+			if err == nil {
+				comm.Disconnect()
+			}
+			checkErrContains(t, err, c.connectErr)
+		})
+	}
+}
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	ed25519Key := newTestSigner(t)
+	rsaKey := newRSASigner(t)
+
+	cases := []struct {
+		name    string
+		hostKey string
+		algs    []string
+	}{
+		{name: "none"},
+		{
+			name:    "ed25519",
+			hostKey: string(ssh.MarshalAuthorizedKey(ed25519Key.PublicKey())),
+			algs:    []string{ssh.KeyAlgoED25519},
+		},
+		{
+			name:    "rsa and ed25519",
+			hostKey: string(ssh.MarshalAuthorizedKey(rsaKey.PublicKey())) + string(ssh.MarshalAuthorizedKey(ed25519Key.PublicKey())),
+			algs:    []string{ssh.KeyAlgoED25519, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA},
+		},
+		{
+			name:    "certificate authority",
+			hostKey: "@cert-authority " + string(ssh.MarshalAuthorizedKey(rsaKey.PublicKey())),
+			algs:    hostCertAlgorithms,
+		},
+		{
+			name:    "fingerprint",
+			hostKey: ssh.FingerprintSHA256(rsaKey.PublicKey()),
+			algs:    hostKeyAlgorithms,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, algs, err := hostKeyCallback("127.0.0.1:22", hostKeyOpts{hop: "target", hostKey: c.hostKey})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(algs, ",") != strings.Join(c.algs, ",") {
+				t.Errorf("algorithms = %v, want %v", algs, c.algs)
+			}
+		})
+	}
+}
+
+func newECDSASigner(t *testing.T) ssh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func newRSASigner(t *testing.T) ssh.Signer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// checkErrContains fails the test unless err contains want, an empty want
+// meaning no error.
+func checkErrContains(t *testing.T, err error, want string) {
+	switch {
+	case want == "" && err != nil:
+		t.Fatalf("unexpected error: %s", err)
+	case want != "" && err == nil:
+		t.Fatalf("expected error containing %q", want)
+	case want != "" && !strings.Contains(err.Error(), want):
+		t.Fatalf("error = %q, want it to contain %q", err, want)
+	}
+}
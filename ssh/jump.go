@@ -0,0 +1,127 @@
+package ssh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JumpHost is one hop in a chain of bastion hosts, the equivalent of an
+// OpenSSH ProxyJump entry. Empty fields fall back to the target's settings.
+type JumpHost struct {
+	User                 string `json:"user"`
+	Host                 string `json:"host"`
+	Port                 int    `json:"port"`
+	Password             string `json:"password"`
+	PrivateKey           string `json:"private_key"`
+	PrivateKeyPassphrase string `json:"private_key_passphrase"`
+	HostKey              string `json:"host_key"`
+	HostKeyMode          string `json:"host_key_mode"`
+	KnownHosts           string `json:"known_hosts"`
+}
+
+// ParseJumpHosts parses an ordered list of jump hosts, either as a JSON list
+// of JumpHost objects or in the OpenSSH shorthand
+// user@host:port,user@host:port.
+func ParseJumpHosts(s string) ([]JumpHost, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	if IsJSONList(s) {
+		var hops []JumpHost
+		if err := json.Unmarshal([]byte(s), &hops); err != nil {
+			return nil, fmt.Errorf("invalid jump hosts: %s", err)
+		}
+		for _, h := range hops {
+			if h.Host == "" {
+				return nil, errors.New("invalid jump hosts: missing host")
+			}
+		}
+		return hops, nil
+	}
+
+	var hops []JumpHost
+	for _, entry := range strings.Split(s, ",") {
+		user, host, port, err := ParseAddress(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jump host: %s", err)
+		}
+		hops = append(hops, JumpHost{User: user, Host: host, Port: port})
+	}
+	return hops, nil
+}
+
+// IsJSONList reports whether s is meant as a JSON list rather than a list of
+// addresses. A bracketed IPv6 address such as [fe80::1]:22 starts with "["
+// too, so s must either be a valid JSON list or open with a string or an
+// object.
+func IsJSONList(s string) bool {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "[") {
+		return false
+	}
+
+	var entries []json.RawMessage
+	if json.Unmarshal([]byte(s), &entries) == nil {
+		return true
+	}
+
+	s = strings.TrimSpace(s[1:])
+	return strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "{")
+}
+
+// ParseAddress parses a [user@]host[:port] address. IPv6 hosts with a port
+// must be enclosed in brackets. A missing port is returned as 0.
+func ParseAddress(s string) (user, host string, port int, err error) {
+	s = strings.TrimSpace(s)
+
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		user = s[:i]
+		s = s[i+1:]
+	}
+
+	// a bare IPv6 address has more than one colon and no port
+	host = s
+	if strings.HasPrefix(s, "[") || strings.Count(s, ":") == 1 {
+		host, port, err = splitHostPort(s)
+		if err != nil {
+			return "", "", 0, err
+		}
+	}
+
+	if host == "" {
+		return "", "", 0, fmt.Errorf("missing host in %q", s)
+	}
+	return user, host, port, nil
+}
+
+func splitHostPort(s string) (string, int, error) {
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return "", 0, fmt.Errorf("invalid host %q: missing ']'", s)
+		}
+		if end == len(s)-1 {
+			return s[1:end], 0, nil
+		}
+		if s[end+1] != ':' {
+			return "", 0, fmt.Errorf("invalid host %q", s)
+		}
+		port, err := strconv.Atoi(s[end+2:])
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid port in %q: %s", s, err)
+		}
+		return s[1:end], port, nil
+	}
+
+	i := strings.LastIndex(s, ":")
+	port, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port in %q: %s", s, err)
+	}
+	return s[:i], port, nil
+}
@@ -0,0 +1,111 @@
+package ssh
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	cases := []struct {
+		input string
+		user  string
+		host  string
+		port  int
+		err   bool
+	}{
+		{"bastion", "", "bastion", 0, false},
+		{" bastion:2222 ", "", "bastion", 2222, false},
+		{"ops@bastion", "ops", "bastion", 0, false},
+		{"ops@bastion:2222", "ops", "bastion", 2222, false},
+		{"ops@corp@bastion", "ops@corp", "bastion", 0, false},
+		{"10.0.0.1:22", "", "10.0.0.1", 22, false},
+		{"fe80::1", "", "fe80::1", 0, false},
+		{"[fe80::1]", "", "fe80::1", 0, false},
+		{"ops@[fe80::1]:2222", "ops", "fe80::1", 2222, false},
+		{"", "", "", 0, true},
+		{"ops@", "", "", 0, true},
+		{":22", "", "", 0, true},
+		{"bastion:ssh", "", "", 0, true},
+		{"[fe80::1:22", "", "", 0, true},
+		{"[fe80::1]22", "", "", 0, true},
+		{"[fe80::1]:x", "", "", 0, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			user, host, port, err := ParseAddress(c.input)
+			if (err != nil) != c.err {
+				t.Fatalf("error = %v, want error: %t", err, c.err)
+			}
+			if user != c.user || host != c.host || port != c.port {
+				t.Errorf("ParseAddress(%q) = %q, %q, %d, want %q, %q, %d",
+					c.input, user, host, port, c.user, c.host, c.port)
+			}
+		})
+	}
+}
+
+func TestParseJumpHosts(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		hops  []JumpHost
+		err   bool
+	}{
+		{
+			name:  "empty",
+			input: " ",
+		},
+		{
+			name:  "shorthand",
+			input: "ops@bastion:2222,[fe80::1]",
+			hops: []JumpHost{
+				{User: "ops", Host: "bastion", Port: 2222},
+				{Host: "fe80::1"},
+			},
+		},
+		{
+			name:  "shorthand starting with an ipv6 address",
+			input: "[fe80::1]:22,ops@bastion",
+			hops: []JumpHost{
+				{Host: "fe80::1", Port: 22},
+				{User: "ops", Host: "bastion"},
+			},
+		},
+		{
+			name:  "json",
+			input: `[{"host": "bastion", "user": "ops", "private_key": "KEY"}, {"host": "inner", "port": 2222, "host_key_mode": "known_hosts"}]`,
+			hops: []JumpHost{
+				{User: "ops", Host: "bastion", PrivateKey: "KEY"},
+				{Host: "inner", Port: 2222, HostKeyMode: "known_hosts"},
+			},
+		},
+		{
+			name:  "shorthand with a bad entry",
+			input: "bastion,,inner",
+			err:   true,
+		},
+		{
+			name:  "invalid json",
+			input: `[{"host": "bastion"`,
+			err:   true,
+		},
+		{
+			name:  "json without host",
+			input: `[{"user": "ops"}]`,
+			err:   true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			hops, err := ParseJumpHosts(c.input)
+			if (err != nil) != c.err {
+				t.Fatalf("error = %v, want error: %t", err, c.err)
+			}
+			if !reflect.DeepEqual(hops, c.hops) {
+				t.Errorf("hops = %+v, want %+v", hops, c.hops)
+			}
+		})
+	}
+}
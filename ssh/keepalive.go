@@ -0,0 +1,66 @@
+package ssh
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultKeepAliveMaxMissed is used if there is no max missed count given
+const DefaultKeepAliveMaxMissed = 3
+
+// keepAlive sends a keepalive@openssh.com request every interval until the
+// client is closed. A request without a reply within the interval counts as
+// missed; after maxMissed misses in a row the peer is declared dead and the
+// client closed, which fails any running command with the reason.
+func (c *SSHCommunicator) keepAlive(client *ssh.Client, interval time.Duration, maxMissed int) {
+	if maxMissed <= 0 {
+		maxMissed = DefaultKeepAliveMaxMissed
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	missed := 0
+	for range t.C {
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		select {
+		case err := <-reply:
+			if err != nil {
+				// the client was closed
+				return
+			}
+			missed = 0
+			continue
+		case <-time.After(interval):
+			missed++
+		}
+
+		log.Printf("[WARN] keepalive %d of %d unanswered", missed, maxMissed)
+		if missed >= maxMissed {
+			c.setLost(fmt.Errorf("connection to %s lost: no reply to %d keepalives sent %s apart",
+				c.connInfo.Host, missed, interval))
+			client.Close()
+			return
+		}
+	}
+}
+
+func (c *SSHCommunicator) setLost(err error) {
+	c.lostMu.Lock()
+	defer c.lostMu.Unlock()
+	c.lost = err
+}
+
+func (c *SSHCommunicator) lostErr() error {
+	c.lostMu.Lock()
+	defer c.lostMu.Unlock()
+	return c.lost
+}
@@ -0,0 +1,67 @@
+package ssh
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKeepAliveLost(t *testing.T) {
+	hostKey := newTestSigner(t)
+	conf := &ssh.ServerConfig{NoClientAuth: true}
+	conf.AddHostKey(hostKey)
+
+	// the server runs commands but leaves keepalive@openssh.com requests
+	// unanswered, like a host that stopped responding mid-converge
+	srv := newTestServer(t, conf, func(sconn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go func() {
+			for range reqs {
+			}
+		}()
+		serveSessions(chans, runTestCommand)
+	})
+	host, portStr, _ := net.SplitHostPort(srv.addr)
+	port, _ := strconv.Atoi(portStr)
+
+	comm, err := New(&ConnectionInfo{
+		User:               "chef",
+		Host:               host,
+		Port:               port,
+		HostKey:            strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostKey.PublicKey()))),
+		TimeoutVal:         5 * time.Second,
+		KeepAliveInterval:  50 * time.Millisecond,
+		KeepAliveMaxMissed: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := comm.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer comm.Disconnect()
+
+	cmd := &Cmd{Command: "sleep", NoPty: true}
+	if err := comm.Start(context.Background(), cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- cmd.Wait() }()
+
+	select {
+	case err = <-errc:
+	case <-time.After(3 * time.Second):
+		t.Fatal("command is still running after the keepalives went unanswered")
+	}
+
+	want := "error executing \"sleep\": connection to 127.0.0.1 lost: no reply to 2 keepalives sent 50ms apart"
+	checkErr(t, err, want)
+	if IsTimeout(err) || IsCancelled(err) {
+		t.Errorf("lost connection reported as a timeout or cancellation: %s", err)
+	}
+}
@@ -0,0 +1,89 @@
+package ssh
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// initialBackoff is the wait before the first connection retry
+	initialBackoff = time.Second
+
+	// maxBackoff caps the wait between connection retries
+	maxBackoff = 30 * time.Second
+)
+
+// retryableMessages are fragments of errors worth retrying that only
+// survive as text, once wrapped by the jump host dialer or the handshake.
+// They are matched case-insensitively, OpenSSH reports a refused forward as
+// "Connection refused".
+var retryableMessages = []string{
+	"connection refused",
+	"connection reset",
+	"no route to host",
+	"network is unreachable",
+	"i/o timeout",
+	"handshake failed: eof",
+}
+
+// retryable reports whether a connection error may go away by itself, such
+// as a host that is still booting. Fatal errors, authentication failures and
+// host key mismatches are permanent.
+func retryable(err error) bool {
+	if _, ok := err.(fatalError); ok {
+		return false
+	}
+
+	msg := err.Error()
+	if strings.Contains(msg, "unable to authenticate") || strings.Contains(msg, "host key") {
+		return false
+	}
+
+	if err == io.EOF {
+		return true
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok && retryableErrno(sysErr.Err) {
+			return true
+		}
+	}
+	// a bastion or jump host that could not reach the target
+	var chanErr *ssh.OpenChannelError
+	if errors.As(err, &chanErr) && chanErr.Reason == ssh.ConnectionFailed {
+		return true
+	}
+
+	msg = strings.ToLower(msg)
+	for _, m := range retryableMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+func retryableErrno(err error) bool {
+	switch err {
+	case syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+		return true
+	}
+	return false
+}
+
+// jitter returns a random duration in [d/2, d] so that many hosts retrying
+// at once do not hit the network in lockstep.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
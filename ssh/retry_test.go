@@ -0,0 +1,62 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRetryable(t *testing.T) {
+	refused := &ssh.OpenChannelError{Reason: ssh.ConnectionFailed, Message: "Connection refused"}
+
+	cases := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"eof", io.EOF, true},
+		{"refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, true},
+		{"timeout", &net.OpError{Op: "dial", Err: timeoutError{}}, true},
+		{"handshake eof", errors.New("ssh: handshake failed: EOF"), true},
+		{"forward refused by the bastion", refused, true},
+		{"forward refused by a jump host", fmt.Errorf("Error connecting to jump host inner:22: %s", refused), true},
+		{"forward refused wrapped", fmt.Errorf("dial: %w", refused), true},
+		{"forward prohibited", &ssh.OpenChannelError{Reason: ssh.Prohibited, Message: "administratively prohibited"}, false},
+		{"jump host unreachable", errors.New("Error connecting to jump host inner:22: dial tcp: No route to host"), true},
+		{"authentication", errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey]"), false},
+		{"host key", errors.New("ssh: handshake failed: target host key verification failed for web1:22"), false},
+		{"fatal", fatalError{errors.New("connection refused")}, false},
+		{"unknown", errors.New("ssh: unexpected message"), false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if retryable(c.err) != c.retryable {
+				t.Errorf("retryable(%q) = %t, want %t", c.err, !c.retryable, c.retryable)
+			}
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestJitter(t *testing.T) {
+	for _, d := range []time.Duration{time.Nanosecond, 3 * time.Nanosecond, time.Second} {
+		for i := 0; i < 1000; i++ {
+			if j := jitter(d); j < d/2 || j > d {
+				t.Fatalf("jitter(%s) = %s, want it in [%s, %s]", d, j, d/2, d)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an in-process SSH server on a loopback port. Every accepted
+// connection is handshaken with conf and then passed to handle, which owns
+// it from there on.
+type testServer struct {
+	addr     string
+	listener net.Listener
+}
+
+func newTestServer(t *testing.T, conf *ssh.ServerConfig, handle func(*ssh.ServerConn, <-chan ssh.NewChannel, <-chan *ssh.Request)) *testServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				sconn, chans, reqs, err := ssh.NewServerConn(conn, conf)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				handle(sconn, chans, reqs)
+			}()
+		}
+	}()
+
+	return &testServer{addr: l.Addr().String(), listener: l}
+}
+
+// newTestSigner returns a fresh ed25519 host or user key.
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// unresponsive accepts the connection but never answers a channel open or
+// request, like a host that went away without closing its connections.
+func unresponsive(sconn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+	go ssh.DiscardRequests(reqs)
+	sconn.Wait()
+}
+
+// execServer runs the commands of every session with run, which gets the
+// command and the signals sent to it and returns its exit status.
+func execServer(run func(command string, signals <-chan string) int) func(*ssh.ServerConn, <-chan ssh.NewChannel, <-chan *ssh.Request) {
+	return func(sconn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go ssh.DiscardRequests(reqs)
+		serveSessions(chans, run)
+	}
+}
+
+// serveSessions accepts session channels and runs the commands they exec
+// with run.
+func serveSessions(chans <-chan ssh.NewChannel, run func(command string, signals <-chan string) int) {
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			signals := make(chan string, 4)
+			for req := range reqs {
+				switch req.Type {
+				case "pty-req":
+					req.Reply(true, nil)
+				case "signal":
+					var msg struct{ Signal string }
+					ssh.Unmarshal(req.Payload, &msg)
+					select {
+					case signals <- msg.Signal:
+					default:
+					}
+				case "exec":
+					var msg struct{ Command string }
+					if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+						req.Reply(false, nil)
+						continue
+					}
+					req.Reply(true, nil)
+					go func() {
+						status := run(msg.Command, signals)
+						ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+						ch.Close()
+					}()
+				default:
+					req.Reply(false, nil)
+				}
+			}
+		}()
+	}
+}
@@ -17,6 +17,9 @@ type sshAgent struct {
 	agent agent.Agent
 	conn  net.Conn
 	id    string
+
+	// cert is the user certificate found next to the identity, if any
+	cert *ssh.Certificate
 }
 
 func (a *sshAgent) Close() error {
@@ -136,6 +139,32 @@ func (s *sshAgent) sortSigners(signers []ssh.Signer) {
 	}
 }
 
+// findIDCertificate looks for an OpenSSH user certificate next to the id
+// file, following the id-cert.pub naming convention.
+func findIDCertificate(id string) *ssh.Certificate {
+	if id == "" {
+		return nil
+	}
+
+	idPath, err := filepath.Abs(strings.TrimSuffix(id, ".pub"))
+	if err != nil {
+		return nil
+	}
+
+	d, err := ioutil.ReadFile(idPath + "-cert.pub")
+	if err != nil {
+		return nil
+	}
+
+	cert, err := parseCertificate(d)
+	if err != nil {
+		log.Printf("[WARN] ignoring certificate for %q: %s", id, err)
+		return nil
+	}
+	log.Printf("[DEBUG] found certificate for identity %q", id)
+	return cert
+}
+
 func (s *sshAgent) Signers() ([]ssh.Signer, error) {
 	signers, err := s.agent.Signers()
 	if err != nil {
@@ -143,7 +172,30 @@ func (s *sshAgent) Signers() ([]ssh.Signer, error) {
 	}
 
 	s.sortSigners(signers)
-	return signers, nil
+	return s.certSigners(signers), nil
+}
+
+// certSigners puts a certificate signer in front of the agent key the
+// certificate was issued for, if the agent holds it.
+func (s *sshAgent) certSigners(signers []ssh.Signer) []ssh.Signer {
+	if s.cert == nil {
+		return signers
+	}
+
+	for _, signer := range signers {
+		if !bytes.Equal(signer.PublicKey().Marshal(), s.cert.Key.Marshal()) {
+			continue
+		}
+		certSigner, err := ssh.NewCertSigner(s.cert, signer)
+		if err != nil {
+			log.Printf("[WARN] unable to use certificate: %s", err)
+			return signers
+		}
+		return append([]ssh.Signer{certSigner}, signers...)
+	}
+
+	log.Printf("[WARN] the agent holds no key matching the certificate")
+	return signers
 }
 
 func (a *sshAgent) Auth() ssh.AuthMethod {
@@ -0,0 +1,117 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestFindIDCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drone-chef-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestSigner(t)
+	pub := newTestSigner(t).PublicKey()
+	userCert := newTestCert(t, pub, ca, ssh.UserCert)
+	files := map[string]string{
+		"id_ed25519-cert.pub": userCert,
+		"id_host-cert.pub":    newTestCert(t, pub, ca, ssh.HostCert),
+		"id_plain-cert.pub":   string(ssh.MarshalAuthorizedKey(pub)),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name  string
+		id    string
+		found bool
+	}{
+		{name: "private key path", id: filepath.Join(dir, "id_ed25519"), found: true},
+		{name: "public key path", id: filepath.Join(dir, "id_ed25519.pub"), found: true},
+		{name: "host certificate", id: filepath.Join(dir, "id_host")},
+		{name: "plain public key", id: filepath.Join(dir, "id_plain")},
+		{name: "no certificate", id: filepath.Join(dir, "id_rsa")},
+		{name: "no identity"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cert := findIDCertificate(c.id)
+			if (cert != nil) != c.found {
+				t.Fatalf("certificate = %v, want found: %t", cert, c.found)
+			}
+			if c.found && string(ssh.MarshalAuthorizedKey(cert)) != userCert {
+				t.Errorf("found a different certificate")
+			}
+		})
+	}
+}
+
+func TestAgentCertSigners(t *testing.T) {
+	ca := newTestSigner(t)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: "id_ed25519"}); err != nil {
+		t.Fatal(err)
+	}
+	held, err := keyring.Signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := held[0].PublicKey()
+
+	parseCert := func(data string) *ssh.Certificate {
+		cert, err := parseCertificate([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	matching := parseCert(newTestCert(t, pub, ca, ssh.UserCert))
+	other := parseCert(newTestCert(t, newTestSigner(t).PublicKey(), ca, ssh.UserCert))
+
+	cases := []struct {
+		name string
+		cert *ssh.Certificate
+
+		// offered are the keys the signers offer, in order
+		offered []ssh.PublicKey
+	}{
+		{name: "no certificate", offered: []ssh.PublicKey{pub}},
+		{name: "agent holds the key", cert: matching, offered: []ssh.PublicKey{matching, pub}},
+		{name: "agent lacks the key", cert: other, offered: []ssh.PublicKey{pub}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := &sshAgent{agent: keyring, cert: c.cert}
+			signers, err := s.Signers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(signers) != len(c.offered) {
+				t.Fatalf("got %d signers, want %d", len(signers), len(c.offered))
+			}
+			for i, signer := range signers {
+				if string(signer.PublicKey().Marshal()) != string(c.offered[i].Marshal()) {
+					t.Errorf("signer %d offers a %s, want a %s", i, signer.PublicKey().Type(), c.offered[i].Type())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package ssh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// the SHA1 test vectors of RFC 6238 appendix B, truncated to 6 digits.
+	// The secret is "12345678901234567890" in base32.
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+	cases := []struct {
+		name   string
+		secret string
+		time   int64
+		code   string
+		err    bool
+	}{
+		{"rfc 59", secret, 59, "287082", false},
+		{"rfc 1111111109", secret, 1111111109, "081804", false},
+		{"rfc 1111111111", secret, 1111111111, "050471", false},
+		{"rfc 1234567890", secret, 1234567890, "005924", false},
+		{"rfc 2000000000", secret, 2000000000, "279037", false},
+		{"rfc 20000000000", secret, 20000000000, "353130", false},
+		{"lower case with spaces", "gezd gnbv gy3t qojq gezd gnbv gy3t qojq", 59, "287082", false},
+		{"padded", "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ====", 59, "287082", false},
+		{"invalid", "not base32!", 59, "", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			code, err := totp(c.secret, time.Unix(c.time, 0))
+			if (err != nil) != c.err {
+				t.Fatalf("error = %v, want error: %t", err, c.err)
+			}
+			if code != c.code {
+				t.Errorf("code = %q, want %q", code, c.code)
+			}
+		})
+	}
+}
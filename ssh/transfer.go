@@ -0,0 +1,422 @@
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// Upload implementation of Communicator.SSHCommunicator interface
+func (c *SSHCommunicator) Upload(ctx context.Context, dst string, input io.Reader, mode os.FileMode) error {
+	sc, err := c.sftpClient(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("[DEBUG] sftp unavailable (%s), falling back to scp", err)
+		return c.scpUpload(ctx, dst, input, mode)
+	}
+	defer sc.Close()
+	defer closeOnDone(ctx, sc)()
+
+	return transferErr(ctx, sftpUpload(sc, dst, input, mode))
+}
+
+// UploadDir implementation of Communicator.SSHCommunicator interface. The
+// contents of the local directory src are copied into dst, which is created
+// if needed but otherwise keeps its mode.
+func (c *SSHCommunicator) UploadDir(ctx context.Context, dst, src string) error {
+	sc, err := c.sftpClient(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("[DEBUG] sftp unavailable (%s), falling back to scp", err)
+		return c.scpUploadDir(ctx, dst, src)
+	}
+	defer sc.Close()
+	defer closeOnDone(ctx, sc)()
+
+	if err := sc.MkdirAll(dst); err != nil {
+		return fmt.Errorf("error creating %s: %s", dst, err)
+	}
+
+	err = walkTree(src, func(p string, info os.FileInfo) error {
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := path.Join(dst, filepath.ToSlash(rel))
+
+		if info.IsDir() {
+			if err := sc.MkdirAll(target); err != nil {
+				return fmt.Errorf("error creating %s: %s", target, err)
+			}
+			return sc.Chmod(target, info.Mode().Perm())
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return sftpUpload(sc, target, f, info.Mode().Perm())
+	}, nil)
+	return transferErr(ctx, err)
+}
+
+// walkTree calls visit for everything below the local directory dir, in
+// lexical order, and leave, if not nil, once a directory's contents are
+// done. Symlinks are followed, so visit is given what they point to and a
+// linked directory is walked like any other; a link back to a directory
+// being walked is an error.
+func walkTree(dir string, visit func(p string, info os.FileInfo) error, leave func(p string) error) error {
+	return walkTreeFrom(dir, map[string]bool{}, visit, leave)
+}
+
+func walkTreeFrom(dir string, ancestors map[string]bool, visit func(string, os.FileInfo) error, leave func(string) error) error {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if ancestors[real] {
+		return fmt.Errorf("symlink loop at %s", dir)
+	}
+	ancestors[real] = true
+	defer delete(ancestors, real)
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		p := filepath.Join(dir, entry.Name())
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		if err := visit(p, info); err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			continue
+		}
+
+		if err := walkTreeFrom(p, ancestors, visit, leave); err != nil {
+			return err
+		}
+		if leave != nil {
+			if err := leave(p); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Download implementation of Communicator.SSHCommunicator interface
+func (c *SSHCommunicator) Download(ctx context.Context, src string, output io.Writer) error {
+	sc, err := c.sftpClient(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("[DEBUG] sftp unavailable (%s), falling back to scp", err)
+		return c.scpDownload(ctx, src, output)
+	}
+	defer sc.Close()
+	defer closeOnDone(ctx, sc)()
+
+	f, err := sc.Open(src)
+	if err != nil {
+		return transferErr(ctx, fmt.Errorf("error opening %s: %s", src, err))
+	}
+	defer f.Close()
+
+	_, err = io.Copy(output, f)
+	return transferErr(ctx, err)
+}
+
+// sftpClient starts an sftp client on the connection, connecting first if
+// needed, and gives up when ctx is done.
+func (c *SSHCommunicator) sftpClient(ctx context.Context) (sc *sftp.Client, err error) {
+	if c.client == nil {
+		if err := c.Connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	err = c.untilDone(ctx, func() (err error) {
+		sc, err = sftp.NewClient(c.client)
+		return err
+	})
+	return sc, err
+}
+
+// closeOnDone closes c once ctx is done, which fails the transfer using it.
+// The returned func stops watching ctx.
+func closeOnDone(ctx context.Context, c io.Closer) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			log.Printf("[WARN] %s, stopping the transfer", ctx.Err())
+			c.Close()
+		}
+	}()
+	return func() { close(done) }
+}
+
+// transferErr returns why the transfer was stopped, if it was, rather than
+// the error it failed with as a result.
+func transferErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func sftpUpload(sc *sftp.Client, dst string, input io.Reader, mode os.FileMode) error {
+	f, err := sc.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %s", dst, err)
+	}
+	defer f.Close()
+
+	// restrict the mode before any content is written
+	if err := f.Chmod(mode); err != nil {
+		return fmt.Errorf("error setting mode on %s: %s", dst, err)
+	}
+	if _, err := io.Copy(f, input); err != nil {
+		return fmt.Errorf("error writing %s: %s", dst, err)
+	}
+	return f.Close()
+}
+
+/***********************************************
+scp fallback, for servers without an sftp subsystem
+**********************************************/
+
+// scpSession runs an scp command remotely and hands its stdin and stdout to
+// fn, which speaks the scp protocol. The session is closed when ctx is done.
+func (c *SSHCommunicator) scpSession(ctx context.Context, command string, fn func(w io.Writer, r *bufio.Reader) error) error {
+	session, err := c.newSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	defer closeOnDone(ctx, session)()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr strings.Builder
+	session.Stderr = &stderr
+
+	log.Printf("[DEBUG] starting remote scp command: %s", command)
+	err = c.untilDone(ctx, func() error {
+		return session.Start(command)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = fn(stdin, bufio.NewReader(stdout))
+	stdin.Close()
+	if err != nil {
+		return transferErr(ctx, err)
+	}
+
+	if err := session.Wait(); err != nil {
+		return transferErr(ctx, fmt.Errorf("scp failed: %s %s", err, strings.TrimSpace(stderr.String())))
+	}
+	return nil
+}
+
+func (c *SSHCommunicator) scpUpload(ctx context.Context, dst string, input io.Reader, mode os.FileMode) error {
+	// the protocol announces the size up front, so spool unknown lengths
+	f, size, release, err := spool(input)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	command := "scp -t " + ShellQuote(path.Dir(dst))
+	return c.scpSession(ctx, command, func(w io.Writer, r *bufio.Reader) error {
+		if err := scpAck(r); err != nil {
+			return err
+		}
+		return scpSendFile(w, r, path.Base(dst), f, size, mode)
+	})
+}
+
+func (c *SSHCommunicator) scpUploadDir(ctx context.Context, dst, src string) error {
+	command := fmt.Sprintf("mkdir -p %s && scp -rt %s", ShellQuote(dst), ShellQuote(dst))
+	return c.scpSession(ctx, command, func(w io.Writer, r *bufio.Reader) error {
+		if err := scpAck(r); err != nil {
+			return err
+		}
+		return scpSendDirContents(w, r, src)
+	})
+}
+
+func (c *SSHCommunicator) scpDownload(ctx context.Context, src string, output io.Writer) error {
+	command := "scp -f " + ShellQuote(src)
+	return c.scpSession(ctx, command, func(w io.Writer, r *bufio.Reader) error {
+		if _, err := w.Write([]byte{0}); err != nil {
+			return err
+		}
+
+		header, err := scpReadHeader(w, r)
+		if err != nil {
+			return err
+		}
+		fields := strings.SplitN(header, " ", 3)
+		if len(fields) != 3 || !strings.HasPrefix(fields[0], "C") {
+			return fmt.Errorf("unexpected scp header %q", header)
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("unexpected scp header %q", header)
+		}
+
+		if _, err := w.Write([]byte{0}); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(output, r, size); err != nil {
+			return err
+		}
+		if err := scpAck(r); err != nil {
+			return err
+		}
+		_, err = w.Write([]byte{0})
+		return err
+	})
+}
+
+func scpSendDirContents(w io.Writer, r *bufio.Reader, dir string) error {
+	return walkTree(dir, func(p string, info os.FileInfo) error {
+		if info.IsDir() {
+			fmt.Fprintf(w, "D%04o 0 %s\n", info.Mode().Perm(), info.Name())
+			return scpAck(r)
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return scpSendFile(w, r, info.Name(), f, info.Size(), info.Mode().Perm())
+	}, func(string) error {
+		fmt.Fprintln(w, "E")
+		return scpAck(r)
+	})
+}
+
+func scpSendFile(w io.Writer, r *bufio.Reader, name string, input io.Reader, size int64, mode os.FileMode) error {
+	fmt.Fprintf(w, "C%04o %d %s\n", mode.Perm(), size, name)
+	if err := scpAck(r); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, input, size); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{0}); err != nil {
+		return err
+	}
+	return scpAck(r)
+}
+
+// scpAck reads a response from the remote scp: a zero byte on success, or
+// a status byte followed by an error message.
+func scpAck(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+
+	msg, _ := r.ReadString('\n')
+	msg = strings.TrimSpace(msg)
+	if msg == "" {
+		msg = fmt.Sprintf("scp status %d", b)
+	}
+	return errors.New(msg)
+}
+
+// scpReadHeader reads a file header. Timestamp records before it are acked,
+// the source waits for that before sending the header, and skipped.
+func scpReadHeader(w io.Writer, r *bufio.Reader) (string, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == 1 || b[0] == 2 {
+			return "", scpAck(r)
+		}
+
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if !strings.HasPrefix(line, "T") {
+			return line, nil
+		}
+		if _, err := w.Write([]byte{0}); err != nil {
+			return "", err
+		}
+	}
+}
+
+// spool returns input along with its size, copying it to a temporary file
+// first unless it is a regular file already. The returned func releases any
+// temporary file.
+func spool(input io.Reader) (io.Reader, int64, func(), error) {
+	if f, ok := input.(*os.File); ok {
+		info, err := f.Stat()
+		if err == nil && info.Mode().IsRegular() {
+			pos, err := f.Seek(0, io.SeekCurrent)
+			if err == nil {
+				return f, info.Size() - pos, func() {}, nil
+			}
+		}
+	}
+
+	tf, err := ioutil.TempFile("", "drone-chef-upload")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	os.Remove(tf.Name())
+
+	size, err := io.Copy(tf, input)
+	if err == nil {
+		_, err = tf.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tf.Close()
+		return nil, 0, nil, err
+	}
+	return tf, size, func() { tf.Close() }, nil
+}
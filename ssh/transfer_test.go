@@ -0,0 +1,314 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestUploadCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hostKey := newTestSigner(t)
+	conf := &ssh.ServerConfig{NoClientAuth: true}
+	conf.AddHostKey(hostKey)
+	srv := newTestServer(t, conf, sftpSubsystem)
+
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		User:            "chef",
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	comm := &SSHCommunicator{
+		connInfo: &ConnectionInfo{Host: "sftp"},
+		client:   client,
+	}
+
+	dst := filepath.Join(dir, "client.rb")
+	if err := comm.Upload(context.Background(), dst, strings.NewReader("log_level :info\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(dst); err != nil || string(b) != "log_level :info\n" {
+		t.Errorf("uploaded %q, %v", b, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- comm.Upload(ctx, filepath.Join(dir, "archive.tgz"), slowReader{}, 0600)
+	}()
+
+	select {
+	case err := <-errc:
+		if err != context.DeadlineExceeded {
+			t.Errorf("error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload is still running after its context expired")
+	}
+}
+
+// slowReader fills every read after a pause, forever.
+type slowReader struct{}
+
+func (slowReader) Read(p []byte) (int, error) {
+	time.Sleep(10 * time.Millisecond)
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+// sftpSubsystem serves the sftp subsystem of every session from the local
+// filesystem.
+func sftpSubsystem(sconn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+		ch, creqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range creqs {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				go func() {
+					defer ch.Close()
+					if server, err := sftp.NewServer(ch); err == nil {
+						server.Serve()
+						server.Close()
+					}
+				}()
+			}
+		}()
+	}
+}
+
+func TestScpAck(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"ok", "\x00", ""},
+		{"warning", "\x01file exists\n", "file exists"},
+		{"fatal", "\x02no space left\n", "no space left"},
+		{"status only", "\x02", "scp status 2"},
+		{"eof", "", "EOF"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := scpAck(bufio.NewReader(strings.NewReader(c.input)))
+			checkErr(t, err, c.err)
+		})
+	}
+}
+
+func TestScpReadHeader(t *testing.T) {
+	cases := []struct {
+		name   string
+		input  string
+		header string
+		acks   string
+		err    string
+	}{
+		{"file", "C0644 5 a.txt\n", "C0644 5 a.txt", "", ""},
+		{"timestamps acked", "T1600000000 0 1600000000 0\nC0600 12 b.rb\n", "C0600 12 b.rb", "\x00", ""},
+		{"error after timestamps", "T1600000000 0 1600000000 0\n\x02disk full\n", "", "\x00", "disk full"},
+		{"error", "\x01scp: b.rb: No such file or directory\n", "", "", "scp: b.rb: No such file or directory"},
+		{"eof", "", "", "", "EOF"},
+		{"unterminated", "C0644 5 a.txt", "", "", "EOF"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var w bytes.Buffer
+			header, err := scpReadHeader(&w, bufio.NewReader(strings.NewReader(c.input)))
+			checkErr(t, err, c.err)
+			if header != c.header {
+				t.Errorf("header = %q, want %q", header, c.header)
+			}
+			if w.String() != c.acks {
+				t.Errorf("acks = %q, want %q", w.String(), c.acks)
+			}
+		})
+	}
+}
+
+func TestScpSendFile(t *testing.T) {
+	cases := []struct {
+		name   string
+		acks   string
+		output string
+		err    string
+	}{
+		{"ok", "\x00\x00", "C0640 5 client.rb\nhello\x00", ""},
+		{"header rejected", "\x01permission denied\n", "C0640 5 client.rb\n", "permission denied"},
+		{"data rejected", "\x00\x02disk full\n", "C0640 5 client.rb\nhello\x00", "disk full"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var w bytes.Buffer
+			r := bufio.NewReader(strings.NewReader(c.acks))
+			err := scpSendFile(&w, r, "client.rb", strings.NewReader("hello"), 5, 0640)
+			checkErr(t, err, c.err)
+			if w.String() != c.output {
+				t.Errorf("sent %q, want %q", w.String(), c.output)
+			}
+		})
+	}
+}
+
+func TestScpSendDirContents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, filepath.Join(dir, "a"), "x", 0600)
+	if err := os.Mkdir(filepath.Join(dir, "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(filepath.Join(dir, "b"), 0755)
+	writeTestFile(t, filepath.Join(dir, "b", "c"), "yz", 0644)
+	if err := os.Symlink("a", filepath.Join(dir, "d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("b", filepath.Join(dir, "e")); err != nil {
+		t.Fatal(err)
+	}
+
+	var w bytes.Buffer
+	acks := bufio.NewReader(bytes.NewReader(make([]byte, 32)))
+	if err := scpSendDirContents(&w, acks, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "C0600 1 a\nx\x00" +
+		"D0755 0 b\n" +
+		"C0644 2 c\nyz\x00" +
+		"E\n" +
+		"C0600 1 d\nx\x00" +
+		"D0755 0 e\n" +
+		"C0644 2 c\nyz\x00" +
+		"E\n"
+	if w.String() != want {
+		t.Errorf("sent %q, want %q", w.String(), want)
+	}
+
+	// a link back up the tree would be copied forever
+	if err := os.Symlink("..", filepath.Join(dir, "b", "loop")); err != nil {
+		t.Fatal(err)
+	}
+	acks = bufio.NewReader(bytes.NewReader(make([]byte, 32)))
+	err = scpSendDirContents(ioutil.Discard, acks, dir)
+	checkErr(t, err, "symlink loop at "+filepath.Join(dir, "b", "loop"))
+}
+
+func TestSpool(t *testing.T) {
+	f, err := ioutil.TempFile("", "spool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	f.WriteString("skip this")
+	f.Seek(5, io.SeekStart)
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		pw.WriteString("from a pipe")
+		pw.Close()
+	}()
+
+	cases := []struct {
+		name    string
+		input   io.Reader
+		content string
+		same    bool
+	}{
+		{"reader", strings.NewReader("hello"), "hello", false},
+		{"regular file from its offset", f, "this", true},
+		{"pipe", pr, "from a pipe", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, size, release, err := spool(c.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer release()
+
+			if size != int64(len(c.content)) {
+				t.Errorf("size = %d, want %d", size, len(c.content))
+			}
+			if (r == c.input) != c.same {
+				t.Errorf("spooled to a temp file: %t, want %t", r != c.input, !c.same)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != c.content {
+				t.Errorf("content = %q, want %q", b, c.content)
+			}
+		})
+	}
+}
+
+func writeTestFile(t *testing.T, name, content string, mode os.FileMode) {
+	if err := ioutil.WriteFile(name, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+	// the umask may have masked the mode
+	if err := os.Chmod(name, mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkErr fails the test unless err matches want, an empty want meaning
+// no error.
+func checkErr(t *testing.T, err error, want string) {
+	switch {
+	case want == "" && err != nil:
+		t.Errorf("unexpected error: %s", err)
+	case want != "" && err == nil:
+		t.Errorf("expected error %q", want)
+	case want != "" && err.Error() != want:
+		t.Errorf("error = %q, want %q", err, want)
+	}
+}
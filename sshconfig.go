@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	sshconfig "github.com/kevinburke/ssh_config"
+	ssh "github.com/zywillc/drone-chef-client/ssh"
+)
+
+// loadSSHConfig parses the ssh-config setting, which is either the path to
+// an OpenSSH client config file or the contents of one.
+func loadSSHConfig(setting string) (*sshconfig.Config, error) {
+	if setting == "" {
+		return nil, nil
+	}
+
+	data := []byte(setting)
+	if !strings.Contains(setting, "\n") {
+		b, err := ioutil.ReadFile(expandHome(setting))
+		if err != nil {
+			return nil, fmt.Errorf("error reading ssh config: %s", err)
+		}
+		data = b
+	}
+
+	cfg, err := sshconfig.DecodeBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing ssh config: %s", err)
+	}
+	return cfg, nil
+}
+
+// sshHost holds the settings ssh config gives for a single host alias.
+type sshHost struct {
+	HostName            string
+	User                string
+	Port                int
+	IdentityFile        string
+	KnownHosts          string
+	Strict              bool
+	ServerAliveInterval time.Duration
+	ProxyJump           string
+}
+
+// lookupSSHHost resolves the settings for alias.
+func lookupSSHHost(cfg *sshconfig.Config, alias string) (h sshHost, err error) {
+	// the parser panics on Match blocks
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("error reading ssh config for %s: %v", alias, r)
+		}
+	}()
+
+	get := func(key string) string {
+		if err != nil {
+			return ""
+		}
+		var v string
+		v, err = cfg.Get(alias, key)
+		return strings.TrimSpace(v)
+	}
+
+	h.HostName = strings.Replace(get("HostName"), "%h", alias, -1)
+	h.User = get("User")
+	h.Strict = strings.EqualFold(get("StrictHostKeyChecking"), "yes")
+	if v := get("ProxyJump"); !strings.EqualFold(v, "none") {
+		h.ProxyJump = v
+	}
+	if v := get("UserKnownHostsFile"); v != "" {
+		// only the first of several files is used
+		h.KnownHosts = expandHome(strings.Fields(v)[0])
+	}
+	if v := get("Port"); v != "" {
+		if h.Port, err = strconv.Atoi(v); err != nil {
+			return h, fmt.Errorf("invalid Port %q in ssh config for %s", v, alias)
+		}
+	}
+	if v := get("ServerAliveInterval"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil {
+			return h, fmt.Errorf("invalid ServerAliveInterval %q in ssh config for %s", v, alias)
+		}
+		h.ServerAliveInterval = time.Duration(secs) * time.Second
+	}
+	if v := get("IdentityFile"); v != "" {
+		h.IdentityFile = expandHome(v)
+	}
+
+	return h, err
+}
+
+// readIdentityFile returns the private key in an IdentityFile. Like ssh(1),
+// a file that does not exist is skipped rather than an error.
+func readIdentityFile(alias, path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	key, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading IdentityFile for %s: %s", alias, err)
+	}
+	return string(key), nil
+}
+
+// withSSHConfig fills connection settings that are not set explicitly from
+// the ssh config entries matching alias, the same way ssh(1) gives command
+// line options precedence over its config file.
+func (c Config) withSSHConfig(alias string) (Config, error) {
+	if c.sshConfig == nil {
+		return c, nil
+	}
+
+	h, err := lookupSSHHost(c.sshConfig, alias)
+	if err != nil {
+		return c, err
+	}
+
+	if h.HostName != "" {
+		c.Host = h.HostName
+	}
+	if c.User == "" {
+		c.User = h.User
+	}
+	if c.Port == 0 {
+		c.Port = h.Port
+	}
+	// an explicit private key makes the IdentityFile irrelevant, for the
+	// jump hosts too, which inherit it
+	explicitKey := c.Private_Key != ""
+	if !explicitKey {
+		if c.Private_Key, err = readIdentityFile(alias, h.IdentityFile); err != nil {
+			return c, err
+		}
+	}
+	if c.Known_Hosts == "" {
+		c.Known_Hosts = h.KnownHosts
+	}
+	if h.Strict {
+		c.Strict_Host_Key_Checking = true
+	}
+	if c.keepaliveInterval == 0 {
+		c.keepaliveInterval = h.ServerAliveInterval
+	}
+	// an explicit bastion counts as an explicit jump host
+	if c.jumpHosts == "" && c.Bastion_Host == "" && h.ProxyJump != "" {
+		if c.jumpHosts, err = c.resolveJumpHosts(h.ProxyJump, !explicitKey); err != nil {
+			return c, err
+		}
+	}
+
+	return c, nil
+}
+
+// resolveJumpHosts resolves every hop of a ProxyJump value through the ssh
+// config, since hops are usually aliases defined in the same file, and
+// returns the chain in the JSON form understood by the jump-hosts setting.
+// The hops' IdentityFile entries are only read if identities is set.
+func (c Config) resolveJumpHosts(proxyJump string, identities bool) (string, error) {
+	hops, err := ssh.ParseJumpHosts(proxyJump)
+	if err != nil {
+		return "", err
+	}
+
+	for i := range hops {
+		hop := &hops[i]
+		alias := hop.Host
+		h, err := lookupSSHHost(c.sshConfig, alias)
+		if err != nil {
+			return "", err
+		}
+
+		if h.HostName != "" {
+			hop.Host = h.HostName
+		}
+		if hop.User == "" {
+			hop.User = h.User
+		}
+		if hop.Port == 0 {
+			hop.Port = h.Port
+		}
+		if identities {
+			if hop.PrivateKey, err = readIdentityFile(alias, h.IdentityFile); err != nil {
+				return "", err
+			}
+		}
+		hop.KnownHosts = h.KnownHosts
+	}
+
+	b, err := json.Marshal(hops)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// expandHome replaces a leading ~ with the home directory.
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		return filepath.Join(os.Getenv("HOME"), path[1:])
+	}
+	return path
+}
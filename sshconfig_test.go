@@ -0,0 +1,322 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	ssh "github.com/zywillc/drone-chef-client/ssh"
+)
+
+// writeSSHConfigFiles writes an identity file and an ssh config referring to
+// it into a temp dir, and returns the path of the config.
+func writeSSHConfigFiles(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "drone-chef-sshconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	key := filepath.Join(dir, "id_web")
+	if err := ioutil.WriteFile(key, []byte("web key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := strings.Join([]string{
+		"Host web",
+		"  HostName web.example.com",
+		"  User deploy",
+		"  Port 2222",
+		"  IdentityFile " + key,
+		"  UserKnownHostsFile /etc/ssh/web_known_hosts /etc/ssh/other",
+		"  StrictHostKeyChecking yes",
+		"  ServerAliveInterval 15",
+		"  ProxyJump bastion",
+		"Host missing",
+		"  IdentityFile " + filepath.Join(dir, "does_not_exist"),
+		"  ProxyJump missing-hop",
+		"Host missing-hop",
+		"  IdentityFile " + filepath.Join(dir, "does_not_exist"),
+		"Host bastion",
+		"  HostName bastion.example.com",
+		"  User ops",
+		"  Port 2200",
+		"  IdentityFile " + key,
+		"  UserKnownHostsFile /etc/ssh/bastion_known_hosts",
+		"Host direct",
+		"  ProxyJump none",
+		"Host db*",
+		"  HostName %h.internal",
+		"Host badport",
+		"  Port ssh",
+		"",
+	}, "\n")
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadSSHConfig(t *testing.T) {
+	path := writeSSHConfigFiles(t)
+	inline, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		setting string
+		err     bool
+	}{
+		{name: "path", setting: path},
+		{name: "inline", setting: string(inline)},
+		{name: "missing path", setting: path + ".missing", err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, err := loadSSHConfig(c.setting)
+			if (err != nil) != c.err {
+				t.Fatalf("error = %v, want error: %t", err, c.err)
+			}
+			if c.err {
+				return
+			}
+			h, err := lookupSSHHost(cfg, "web")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.HostName != "web.example.com" {
+				t.Errorf("HostName = %q, want web.example.com", h.HostName)
+			}
+		})
+	}
+
+	if cfg, err := loadSSHConfig(""); cfg != nil || err != nil {
+		t.Errorf("empty setting = %v, %v, want nil, nil", cfg, err)
+	}
+}
+
+func TestLookupSSHHost(t *testing.T) {
+	path := writeSSHConfigFiles(t)
+	cfg, err := loadSSHConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Dir(path)
+
+	cases := []struct {
+		alias string
+		host  sshHost
+		err   bool
+	}{
+		{
+			alias: "web",
+			host: sshHost{
+				HostName:            "web.example.com",
+				User:                "deploy",
+				Port:                2222,
+				IdentityFile:        filepath.Join(dir, "id_web"),
+				KnownHosts:          "/etc/ssh/web_known_hosts",
+				Strict:              true,
+				ServerAliveInterval: 15 * time.Second,
+				ProxyJump:           "bastion",
+			},
+		},
+		{alias: "direct"},
+		{alias: "db1", host: sshHost{HostName: "db1.internal"}},
+		{alias: "unknown"},
+		{alias: "badport", err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.alias, func(t *testing.T) {
+			h, err := lookupSSHHost(cfg, c.alias)
+			if (err != nil) != c.err {
+				t.Fatalf("error = %v, want error: %t", err, c.err)
+			}
+			if !c.err && h != c.host {
+				t.Errorf("host =\n%+v\nwant\n%+v", h, c.host)
+			}
+		})
+	}
+}
+
+func TestWithSSHConfig(t *testing.T) {
+	path := writeSSHConfigFiles(t)
+	cfg, err := loadSSHConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		conf  Config
+		alias string
+		want  func(*Config)
+	}{
+		{
+			name:  "filled from config",
+			alias: "web",
+			want: func(c *Config) {
+				c.Host = "web.example.com"
+				c.User = "deploy"
+				c.Port = 2222
+				c.Private_Key = "web key"
+				c.Known_Hosts = "/etc/ssh/web_known_hosts"
+				c.Strict_Host_Key_Checking = true
+				c.keepaliveInterval = 15 * time.Second
+				c.jumpHosts = `[{"user":"ops","host":"bastion.example.com","port":2200,"password":"","private_key":"web key","private_key_passphrase":"","host_key":"","host_key_mode":"","known_hosts":"/etc/ssh/bastion_known_hosts"}]`
+			},
+		},
+		{
+			name: "explicit settings win",
+			conf: Config{
+				User:              "root",
+				Port:              22,
+				Private_Key:       "explicit key",
+				Known_Hosts:       "/etc/ssh/known_hosts",
+				keepaliveInterval: time.Minute,
+				jumpHosts:         "jump",
+			},
+			alias: "web",
+			want: func(c *Config) {
+				c.Host = "web.example.com"
+				c.Strict_Host_Key_Checking = true
+			},
+		},
+		{
+			name:  "explicit bastion",
+			conf:  Config{Bastion_Host: "gateway.example.com", Bastion_User: "ops"},
+			alias: "web",
+			want: func(c *Config) {
+				c.Host = "web.example.com"
+				c.User = "deploy"
+				c.Port = 2222
+				c.Private_Key = "web key"
+				c.Known_Hosts = "/etc/ssh/web_known_hosts"
+				c.Strict_Host_Key_Checking = true
+				c.keepaliveInterval = 15 * time.Second
+			},
+		},
+		{
+			name:  "explicit key skips missing identity files",
+			conf:  Config{Private_Key: "explicit key"},
+			alias: "missing",
+			want: func(c *Config) {
+				c.jumpHosts = `[{"user":"","host":"missing-hop","port":0,"password":"","private_key":"","private_key_passphrase":"","host_key":"","host_key_mode":"","known_hosts":""}]`
+			},
+		},
+		{
+			name:  "missing identity files are ignored",
+			alias: "missing",
+			want: func(c *Config) {
+				c.jumpHosts = `[{"user":"","host":"missing-hop","port":0,"password":"","private_key":"","private_key_passphrase":"","host_key":"","host_key_mode":"","known_hosts":""}]`
+			},
+		},
+		{
+			name:  "proxy jump none",
+			alias: "direct",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := c.conf
+			conf.Host = c.alias
+			conf.sshConfig = cfg
+
+			want := conf
+			if c.want != nil {
+				c.want(&want)
+			}
+
+			got, err := conf.withSSHConfig(c.alias)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("config =\n%+v\nwant\n%+v", got, want)
+			}
+		})
+	}
+
+	conf := Config{Host: "web"}
+	if got, err := conf.withSSHConfig("web"); err != nil || !reflect.DeepEqual(got, conf) {
+		t.Errorf("without ssh config = %+v, %v, want it unchanged", got, err)
+	}
+}
+
+func TestResolveJumpHosts(t *testing.T) {
+	path := writeSSHConfigFiles(t)
+	cfg, err := loadSSHConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{sshConfig: cfg}
+
+	cases := []struct {
+		name       string
+		proxyJump  string
+		identities bool
+		hops       []ssh.JumpHost
+		err        bool
+	}{
+		{
+			name:       "user and port inherited from the hop alias",
+			proxyJump:  "bastion,inner",
+			identities: true,
+			hops: []ssh.JumpHost{
+				{User: "ops", Host: "bastion.example.com", Port: 2200, PrivateKey: "web key", KnownHosts: "/etc/ssh/bastion_known_hosts"},
+				{Host: "inner"},
+			},
+		},
+		{
+			name:       "user and port given in the jump win",
+			proxyJump:  "root@bastion:22",
+			identities: true,
+			hops: []ssh.JumpHost{
+				{User: "root", Host: "bastion.example.com", Port: 22, PrivateKey: "web key", KnownHosts: "/etc/ssh/bastion_known_hosts"},
+			},
+		},
+		{
+			name:      "identity files not read",
+			proxyJump: "bastion",
+			hops: []ssh.JumpHost{
+				{User: "ops", Host: "bastion.example.com", Port: 2200, KnownHosts: "/etc/ssh/bastion_known_hosts"},
+			},
+		},
+		{
+			name:       "missing identity file",
+			proxyJump:  "missing-hop",
+			identities: true,
+			hops:       []ssh.JumpHost{{Host: "missing-hop"}},
+		},
+		{name: "invalid", proxyJump: "bastion:port", err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, err := conf.resolveJumpHosts(c.proxyJump, c.identities)
+			if (err != nil) != c.err {
+				t.Fatalf("error = %v, want error: %t", err, c.err)
+			}
+			if c.err {
+				return
+			}
+			hops, err := ssh.ParseJumpHosts(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(hops, c.hops) {
+				t.Errorf("hops =\n%+v\nwant\n%+v", hops, c.hops)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+var (
+	ansiRe         = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+	whyRunResRe    = regexp.MustCompile(`^\s*\* (\S+\[.*\]) action (\S+)(.*)$`)
+	whyRunChangeRe = regexp.MustCompile(`^\s*- (Would .*)$`)
+)
+
+// pendingChange is a resource that a why-run reports it would update.
+type pendingChange struct {
+	Resource string   `json:"resource"`
+	Action   string   `json:"action"`
+	Changes  []string `json:"changes"`
+}
+
+// parseWhyRun extracts the resources that would change from the output of
+// chef-client --why-run. Resources reported as up to date or skipped carry
+// no "Would ..." lines and are left out.
+func parseWhyRun(output []byte) []pendingChange {
+	var (
+		pending []pendingChange
+		current *pendingChange
+	)
+
+	flush := func() {
+		if current != nil && len(current.Changes) > 0 {
+			pending = append(pending, *current)
+		}
+		current = nil
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(ansiRe.ReplaceAll(output, nil)))
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+
+		if m := whyRunResRe.FindStringSubmatch(line); m != nil {
+			flush()
+			current = &pendingChange{Resource: m[1], Action: m[2]}
+			continue
+		}
+
+		if m := whyRunChangeRe.FindStringSubmatch(line); m != nil && current != nil {
+			current.Changes = append(current.Changes, m[1])
+		}
+	}
+	flush()
+
+	return pending
+}
+
+// printWhyRunSummary lists the pending changes found on every host.
+func printWhyRunSummary(w io.Writer, results []hostResult) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+
+	for _, r := range results {
+		if r.Skipped || r.Err != nil {
+			continue
+		}
+		if len(r.Pending) == 0 {
+			fmt.Fprintf(w, "%s: no changes\n", r.Host)
+			continue
+		}
+		fmt.Fprintf(w, "%s: %d resources would change\n", r.Host, len(r.Pending))
+		for _, c := range r.Pending {
+			fmt.Fprintf(w, "  * %s action %s\n", c.Resource, c.Action)
+			for _, line := range c.Changes {
+				fmt.Fprintf(w, "    - %s\n", line)
+			}
+		}
+	}
+}
+
+// writeWhyRunReport writes the pending changes for every host as JSON.
+func writeWhyRunReport(path string, results []hostResult) error {
+	type hostReport struct {
+		Host    string          `json:"host"`
+		Status  string          `json:"status"`
+		Error   string          `json:"error,omitempty"`
+		Pending []pendingChange `json:"pending"`
+	}
+
+	report := make([]hostReport, 0, len(results))
+	for _, r := range results {
+		h := hostReport{
+			Host:    r.Host,
+			Status:  "ok",
+			Pending: r.Pending,
+		}
+		switch {
+		case r.Skipped:
+			h.Status = "skipped"
+		case r.Err != nil:
+			h.Status = "failed"
+			h.Error = r.Err.Error()
+		}
+		if h.Pending == nil {
+			h.Pending = []pendingChange{}
+		}
+		report = append(report, h)
+	}
+
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseWhyRun(t *testing.T) {
+	cases := []struct {
+		name    string
+		output  string
+		pending []pendingChange
+	}{
+		{
+			name:    "empty",
+			output:  "",
+			pending: nil,
+		},
+		{
+			name: "up to date",
+			output: "Recipe: base::default\n" +
+				"  * package[ntp] action install (up to date)\n" +
+				"  * service[ntp] action start (skipped due to only_if)\n",
+			pending: nil,
+		},
+		{
+			name: "changes",
+			output: "Recipe: base::default\n" +
+				"  * package[ntp] action install\n" +
+				"    - Would install version 4.2 of package ntp\n" +
+				"  * service[ntp] action start (up to date)\n" +
+				"  * template[/etc/ntp.conf] action create\n" +
+				"    - Would update content in file /etc/ntp.conf from 1a2b to 3c4d\n" +
+				"    - Would change mode from '0600' to '0644'\r\n",
+			pending: []pendingChange{
+				{
+					Resource: "package[ntp]",
+					Action:   "install",
+					Changes:  []string{"Would install version 4.2 of package ntp"},
+				},
+				{
+					Resource: "template[/etc/ntp.conf]",
+					Action:   "create",
+					Changes: []string{
+						"Would update content in file /etc/ntp.conf from 1a2b to 3c4d",
+						"Would change mode from '0600' to '0644'",
+					},
+				},
+			},
+		},
+		{
+			name: "colored",
+			output: "  * \x1b[32mfile[/tmp/a b]\x1b[0m action create\n" +
+				"    - \x1b[32mWould create new file /tmp/a b\x1b[0m\n",
+			pending: []pendingChange{
+				{
+					Resource: "file[/tmp/a b]",
+					Action:   "create",
+					Changes:  []string{"Would create new file /tmp/a b"},
+				},
+			},
+		},
+		{
+			name: "change before any resource",
+			output: "    - Would do something\n" +
+				"  * user[deploy] action create\n" +
+				"    - Would create user deploy\n",
+			pending: []pendingChange{
+				{
+					Resource: "user[deploy]",
+					Action:   "create",
+					Changes:  []string{"Would create user deploy"},
+				},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pending := parseWhyRun([]byte(c.output))
+			if !reflect.DeepEqual(pending, c.pending) {
+				t.Errorf("pending = %#v, want %#v", pending, c.pending)
+			}
+		})
+	}
+}